@@ -0,0 +1,386 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+const (
+	_grpcBootstrapEnv = "GRPC_XDS_BOOTSTRAP"
+
+	_channelCredsInsecure = "insecure"
+	_channelCredsTLS      = "tls"
+
+	_serverFeatureV3 = "xds_v3"
+
+	_transportSocketTLS       = "envoy.transport_sockets.tls"
+	_transportSocketRawBuffer = "envoy.transport_sockets.raw_buffer"
+)
+
+// grpcBootstrap is the xDS bootstrap file of the proxyless gRPC clients, only
+// the fields about the control plane are parsed, the certificate providers
+// are for the data plane.
+type grpcBootstrap struct {
+	XDSServers []grpcXDSServer  `json:"xds_servers"`
+	Node       *json.RawMessage `json:"node"`
+}
+
+type grpcXDSServer struct {
+	ServerURI      string             `json:"server_uri"`
+	ChannelCreds   []grpcChannelCreds `json:"channel_creds"`
+	ServerFeatures []string           `json:"server_features"`
+}
+
+type grpcChannelCreds struct {
+	Type   string          `json:"type"`
+	Config grpcTLSCredsCfg `json:"config"`
+}
+
+// grpcTLSCredsCfg is the config of the "tls" channel credentials.
+type grpcTLSCredsCfg struct {
+	CACertificateFile string `json:"ca_certificate_file"`
+	CertificateFile   string `json:"certificate_file"`
+	PrivateKeyFile    string `json:"private_key_file"`
+}
+
+// applyGRPCBootstrap fills the options from the gRPC xDS bootstrap file given
+// by --bootstrap or the GRPC_XDS_BOOTSTRAP environment variable. Like gRPC,
+// only the first server is used, with the first supported channel
+// credentials. The options specified explicitly take precedence.
+func applyGRPCBootstrap(cmd *cobra.Command) error {
+	path := _gFlags.bootstrap
+	if path == "" {
+		path = os.Getenv(_grpcBootstrapEnv)
+	}
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bootstrap := &grpcBootstrap{}
+	if err := json.Unmarshal(data, bootstrap); err != nil {
+		return fmt.Errorf("%v: %s", _errInvalidBootstrap, err)
+	}
+	if len(bootstrap.XDSServers) == 0 {
+		return fmt.Errorf("%v: no xds_servers", _errInvalidBootstrap)
+	}
+	server := bootstrap.XDSServers[0]
+
+	// The channel credentials and the server features are about the server,
+	// they're ignored if the server is overridden.
+	if !cmd.Flags().Changed("servers") {
+		_gFlags.servers = []string{server.ServerURI}
+
+		if !cmd.Flags().Changed("api-version") {
+			_gFlags.xds.apiVersion = _apiVersion2
+			if containsString(server.ServerFeatures, _serverFeatureV3) {
+				_gFlags.xds.apiVersion = _apiVersion3
+			}
+		}
+
+		creds, err := selectChannelCreds(server.ChannelCreds)
+		if err != nil {
+			return err
+		}
+		if creds.Type == _channelCredsTLS && _gFlags.tls == (tlsFlags{}) {
+			_gFlags.tls = tlsFlags{
+				enabled: true,
+				cacert:  creds.Config.CACertificateFile,
+				cert:    creds.Config.CertificateFile,
+				key:     creds.Config.PrivateKeyFile,
+			}
+		}
+	}
+
+	if bootstrap.Node != nil {
+		node := &corev3.Node{}
+		unmarshaler := &jsonpb.Unmarshaler{AllowUnknownFields: true}
+		if err := unmarshaler.Unmarshal(bytes.NewReader(*bootstrap.Node), node); err != nil {
+			return fmt.Errorf("%v: %s", _errInvalidBootstrap, err)
+		}
+		_gFlags.xds.bootstrapNode = node
+	}
+	return nil
+}
+
+func selectChannelCreds(creds []grpcChannelCreds) (*grpcChannelCreds, error) {
+	for i := range creds {
+		switch creds[i].Type {
+		case _channelCredsInsecure, _channelCredsTLS:
+			return &creds[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%v: no supported channel_creds", _errInvalidBootstrap)
+}
+
+// envoyBootstrap is the Envoy bootstrap, only the node and the ADS cluster are
+// parsed, so the bootstraps with any extension are accepted.
+type envoyBootstrap struct {
+	Node            interface{} `yaml:"node"`
+	StaticResources struct {
+		Clusters []envoyCluster `yaml:"clusters"`
+	} `yaml:"static_resources"`
+	DynamicResources struct {
+		ADSConfig *envoyADSConfig `yaml:"ads_config"`
+	} `yaml:"dynamic_resources"`
+}
+
+type envoyADSConfig struct {
+	APIType             string `yaml:"api_type"`
+	TransportAPIVersion string `yaml:"transport_api_version"`
+	GRPCServices        []struct {
+		EnvoyGRPC *struct {
+			ClusterName string `yaml:"cluster_name"`
+		} `yaml:"envoy_grpc"`
+		InitialMetadata []struct {
+			Key   string `yaml:"key"`
+			Value string `yaml:"value"`
+		} `yaml:"initial_metadata"`
+	} `yaml:"grpc_services"`
+}
+
+type envoyCluster struct {
+	Name           string `yaml:"name"`
+	LoadAssignment struct {
+		Endpoints []struct {
+			LbEndpoints []struct {
+				Endpoint struct {
+					Address envoyAddress `yaml:"address"`
+				} `yaml:"endpoint"`
+			} `yaml:"lb_endpoints"`
+		} `yaml:"endpoints"`
+	} `yaml:"load_assignment"`
+	TransportSocket *struct {
+		Name        string `yaml:"name"`
+		TypedConfig struct {
+			SNI              string `yaml:"sni"`
+			CommonTLSContext struct {
+				TLSCertificates []struct {
+					CertificateChain envoyDataSource `yaml:"certificate_chain"`
+					PrivateKey       envoyDataSource `yaml:"private_key"`
+				} `yaml:"tls_certificates"`
+				TLSCertificateSDSSecretConfigs   []interface{}           `yaml:"tls_certificate_sds_secret_configs"`
+				ValidationContext                *envoyValidationContext `yaml:"validation_context"`
+				ValidationContextSDSSecretConfig interface{}             `yaml:"validation_context_sds_secret_config"`
+				CombinedValidationContext        *struct {
+					DefaultValidationContext         *envoyValidationContext `yaml:"default_validation_context"`
+					ValidationContextSDSSecretConfig interface{}             `yaml:"validation_context_sds_secret_config"`
+				} `yaml:"combined_validation_context"`
+			} `yaml:"common_tls_context"`
+		} `yaml:"typed_config"`
+	} `yaml:"transport_socket"`
+}
+
+type envoyAddress struct {
+	SocketAddress *struct {
+		Address   string `yaml:"address"`
+		PortValue int    `yaml:"port_value"`
+	} `yaml:"socket_address"`
+	Pipe *struct {
+		Path string `yaml:"path"`
+	} `yaml:"pipe"`
+}
+
+type envoyValidationContext struct {
+	TrustedCA envoyDataSource `yaml:"trusted_ca"`
+}
+
+// envoyDataSource is the data source of the TLS files, only the filename is
+// supported since the TLS flags take files.
+type envoyDataSource struct {
+	Filename string `yaml:"filename"`
+}
+
+// applyEnvoyBootstrap fills the options from the Envoy bootstrap given by
+// --envoy-bootstrap. The servers are the endpoints of the static cluster that
+// the ADS config refers to, with its TLS transport socket, and the gRPC
+// initial metadata are sent as the headers to them. The options specified
+// explicitly take precedence.
+func applyEnvoyBootstrap(cmd *cobra.Command) error {
+	data, err := ioutil.ReadFile(_gFlags.envoyBootstrap)
+	if err != nil {
+		return err
+	}
+	bootstrap := &envoyBootstrap{}
+	if err := yaml.Unmarshal(data, bootstrap); err != nil {
+		return fmt.Errorf("%v: %s", _errInvalidEnvoyBootstrap, err)
+	}
+
+	ads := bootstrap.DynamicResources.ADSConfig
+	if ads == nil || len(ads.GRPCServices) == 0 || ads.GRPCServices[0].EnvoyGRPC == nil {
+		return fmt.Errorf("%v: no envoy_grpc service in the ads_config", _errInvalidEnvoyBootstrap)
+	}
+	service := ads.GRPCServices[0]
+
+	if !cmd.Flags().Changed("servers") {
+		var cluster *envoyCluster
+		for i := range bootstrap.StaticResources.Clusters {
+			if bootstrap.StaticResources.Clusters[i].Name == service.EnvoyGRPC.ClusterName {
+				cluster = &bootstrap.StaticResources.Clusters[i]
+				break
+			}
+		}
+		if cluster == nil {
+			return fmt.Errorf("%v: no static cluster %s", _errInvalidEnvoyBootstrap, service.EnvoyGRPC.ClusterName)
+		}
+		servers, err := envoyClusterServers(cluster)
+		if err != nil {
+			return err
+		}
+		_gFlags.servers = servers
+
+		if cluster.TransportSocket != nil && _gFlags.tls == (tlsFlags{}) {
+			tls, err := envoyClusterTLS(cluster)
+			if err != nil {
+				return err
+			}
+			_gFlags.tls = tls
+		}
+
+		// The initial metadata may carry the credentials of the cluster,
+		// they're not sent to the servers specified explicitly.
+		_gFlags.bootstrapHeaders = nil
+		for _, md := range service.InitialMetadata {
+			_gFlags.bootstrapHeaders = append(_gFlags.bootstrapHeaders, md.Key+"="+md.Value)
+		}
+	}
+
+	// Like the recent Envoy releases, the unset and AUTO transport API
+	// versions are v3.
+	if !cmd.Flags().Changed("api-version") {
+		_gFlags.xds.apiVersion = _apiVersion3
+		if ads.TransportAPIVersion == "V2" {
+			_gFlags.xds.apiVersion = _apiVersion2
+		}
+	}
+	if !cmd.Flags().Changed("delta") {
+		_gFlags.delta = ads.APIType == "DELTA_GRPC"
+	}
+
+	if bootstrap.Node != nil {
+		data, err := json.Marshal(jsonCompatible(bootstrap.Node))
+		if err != nil {
+			return fmt.Errorf("%v: %s", _errInvalidEnvoyBootstrap, err)
+		}
+		node := &corev3.Node{}
+		unmarshaler := &jsonpb.Unmarshaler{AllowUnknownFields: true}
+		if err := unmarshaler.Unmarshal(bytes.NewReader(data), node); err != nil {
+			return fmt.Errorf("%v: %s", _errInvalidEnvoyBootstrap, err)
+		}
+		_gFlags.xds.bootstrapNode = node
+	}
+	return nil
+}
+
+// envoyClusterTLS makes the TLS options from the transport socket of the
+// cluster, only the certificates from files are supported.
+func envoyClusterTLS(cluster *envoyCluster) (tlsFlags, error) {
+	socket := cluster.TransportSocket
+	switch socket.Name {
+	case _transportSocketTLS:
+	case _transportSocketRawBuffer:
+		return tlsFlags{}, nil
+	default:
+		return tlsFlags{}, fmt.Errorf("%v: unsupported transport socket %s in the cluster %s",
+			_errInvalidEnvoyBootstrap, socket.Name, cluster.Name)
+	}
+
+	tlsContext := socket.TypedConfig.CommonTLSContext
+	validationContext := tlsContext.ValidationContext
+	validationFromSDS := tlsContext.ValidationContextSDSSecretConfig != nil
+	if combined := tlsContext.CombinedValidationContext; combined != nil {
+		validationContext = combined.DefaultValidationContext
+		validationFromSDS = combined.ValidationContextSDSSecretConfig != nil
+	}
+	if validationFromSDS {
+		return tlsFlags{}, fmt.Errorf("%v: the validation context from SDS in the cluster %s, specify it with --cacert",
+			_errInvalidEnvoyBootstrap, cluster.Name)
+	}
+	if len(tlsContext.TLSCertificateSDSSecretConfigs) > 0 {
+		return tlsFlags{}, fmt.Errorf("%v: the certificates from SDS in the cluster %s, specify them with --cert and --key",
+			_errInvalidEnvoyBootstrap, cluster.Name)
+	}
+
+	tls := tlsFlags{
+		enabled:    true,
+		serverName: socket.TypedConfig.SNI,
+	}
+	if validationContext != nil {
+		tls.cacert = validationContext.TrustedCA.Filename
+	}
+	if len(tlsContext.TLSCertificates) > 0 {
+		tls.cert = tlsContext.TLSCertificates[0].CertificateChain.Filename
+		tls.key = tlsContext.TLSCertificates[0].PrivateKey.Filename
+	}
+	return tls, nil
+}
+
+// envoyClusterServers makes the server targets of the cluster endpoints, the
+// pipes are the unix domain sockets.
+func envoyClusterServers(cluster *envoyCluster) ([]string, error) {
+	var servers []string
+	for _, locality := range cluster.LoadAssignment.Endpoints {
+		for _, lbEndpoint := range locality.LbEndpoints {
+			address := lbEndpoint.Endpoint.Address
+			switch {
+			case address.Pipe != nil:
+				servers = append(servers, _unixScheme+":"+address.Pipe.Path)
+			case address.SocketAddress != nil:
+				servers = append(servers, net.JoinHostPort(address.SocketAddress.Address,
+					strconv.Itoa(address.SocketAddress.PortValue)))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%v: no endpoints in the cluster %s", _errInvalidEnvoyBootstrap, cluster.Name)
+	}
+	return servers, nil
+}
+
+// jsonCompatible converts the maps decoded by yaml, whose keys are
+// interface{}, to the ones that encoding/json accepts.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
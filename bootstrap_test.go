@@ -0,0 +1,244 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// newBootstrapTestCommand makes the command with the flags that the bootstrap
+// files fill, the specified ones are set as if they were on the command line.
+func newBootstrapTestCommand(t *testing.T, flags map[string]string) *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.Flags().StringSlice("servers", nil, "")
+	cmd.Flags().String("api-version", "", "")
+	cmd.Flags().Bool("delta", false, "")
+	for name, value := range flags {
+		if err := cmd.Flags().Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cmd
+}
+
+func TestApplyGRPCBootstrap(t *testing.T) {
+	saved := *_gFlags
+	defer func() { *_gFlags = saved }()
+
+	tests := []struct {
+		file       string
+		flags      map[string]string
+		tls        tlsFlags
+		servers    []string
+		apiVersion string
+		nodeID     string
+		err        bool
+	}{
+		{
+			file:    "testdata/grpc_bootstrap.json",
+			servers: []string{"xds.test:15012"},
+			tls: tlsFlags{
+				enabled: true,
+				cacert:  "/etc/certs/root-cert.pem",
+				cert:    "/etc/certs/cert-chain.pem",
+				key:     "/etc/certs/key.pem",
+			},
+			apiVersion: _apiVersion3,
+			nodeID:     "sidecar~10.0.0.1~a.b~b.svc.cluster.local",
+		},
+		{
+			// The server related options are not taken if the servers are
+			// specified.
+			file:       "testdata/grpc_bootstrap.json",
+			flags:      map[string]string{"servers": "127.0.0.1:15010"},
+			apiVersion: _apiVersion2,
+			nodeID:     "sidecar~10.0.0.1~a.b~b.svc.cluster.local",
+		},
+		{
+			file:       "testdata/grpc_bootstrap.json",
+			flags:      map[string]string{"api-version": _apiVersion2},
+			servers:    []string{"xds.test:15012"},
+			apiVersion: _apiVersion2,
+			tls: tlsFlags{
+				enabled: true,
+				cacert:  "/etc/certs/root-cert.pem",
+				cert:    "/etc/certs/cert-chain.pem",
+				key:     "/etc/certs/key.pem",
+			},
+			nodeID: "sidecar~10.0.0.1~a.b~b.svc.cluster.local",
+		},
+		{
+			file:       "testdata/grpc_bootstrap_insecure.json",
+			servers:    []string{"unix:///var/run/xds.sock"},
+			apiVersion: _apiVersion2,
+		},
+		{file: "testdata/grpc_bootstrap_alts.json", err: true},
+		{file: "testdata/not_exist.json", err: true},
+	}
+
+	for _, tt := range tests {
+		*_gFlags = globalFlags{bootstrap: tt.file}
+		_gFlags.xds.apiVersion = _apiVersion2
+		if tt.flags["servers"] != "" {
+			_gFlags.servers = []string{tt.flags["servers"]}
+		}
+		err := applyGRPCBootstrap(newBootstrapTestCommand(t, tt.flags))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.file)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+
+		servers := tt.servers
+		if servers == nil {
+			servers = []string{tt.flags["servers"]}
+		}
+		if !reflect.DeepEqual(_gFlags.servers, servers) {
+			t.Errorf("%s: servers are %v, expected %v", tt.file, _gFlags.servers, servers)
+		}
+		if _gFlags.tls != tt.tls {
+			t.Errorf("%s: TLS options are %+v, expected %+v", tt.file, _gFlags.tls, tt.tls)
+		}
+		if _gFlags.xds.apiVersion != tt.apiVersion {
+			t.Errorf("%s: api version is %s, expected %s", tt.file, _gFlags.xds.apiVersion, tt.apiVersion)
+		}
+		if id := _gFlags.xds.bootstrapNode.GetId(); id != tt.nodeID {
+			t.Errorf("%s: node id is %q, expected %q", tt.file, id, tt.nodeID)
+		}
+	}
+}
+
+func TestApplyGRPCBootstrapEnv(t *testing.T) {
+	saved := *_gFlags
+	defer func() { *_gFlags = saved }()
+	defer os.Unsetenv(_grpcBootstrapEnv)
+
+	*_gFlags = globalFlags{}
+	os.Setenv(_grpcBootstrapEnv, "testdata/grpc_bootstrap.json")
+	if err := applyGRPCBootstrap(newBootstrapTestCommand(t, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(_gFlags.servers, []string{"xds.test:15012"}) {
+		t.Errorf("servers are %v", _gFlags.servers)
+	}
+	if zone := _gFlags.xds.bootstrapNode.GetLocality().GetZone(); zone != "z1" {
+		t.Errorf("node zone is %q", zone)
+	}
+}
+
+func TestApplyEnvoyBootstrap(t *testing.T) {
+	saved := *_gFlags
+	defer func() { *_gFlags = saved }()
+
+	tests := []struct {
+		file       string
+		flags      map[string]string
+		tls        tlsFlags
+		servers    []string
+		headers    []string
+		apiVersion string
+		delta      bool
+		nodeID     string
+		err        bool
+	}{
+		{
+			file:    "testdata/envoy_bootstrap.yaml",
+			servers: []string{"xds.test:15012"},
+			tls: tlsFlags{
+				enabled:    true,
+				serverName: "istiod.istio-system.svc",
+				cacert:     "/etc/certs/root-cert.pem",
+				cert:       "/etc/certs/cert-chain.pem",
+				key:        "/etc/certs/key.pem",
+			},
+			headers:    []string{"authorization=Bearer token"},
+			apiVersion: _apiVersion3,
+			nodeID:     "sidecar~10.0.0.1~a.b~b.svc.cluster.local",
+		},
+		{
+			file: "testdata/envoy_bootstrap.yaml",
+			// The initial metadata are not sent to the servers specified
+			// explicitly.
+			flags:      map[string]string{"servers": "127.0.0.1:15010", "delta": "true"},
+			servers:    []string{"127.0.0.1:15010"},
+			apiVersion: _apiVersion3,
+			delta:      true,
+			nodeID:     "sidecar~10.0.0.1~a.b~b.svc.cluster.local",
+		},
+		{
+			file:       "testdata/envoy_bootstrap_pipe.yaml",
+			servers:    []string{"unix:/var/run/xds.sock"},
+			apiVersion: _apiVersion3,
+			delta:      true,
+		},
+		{
+			file:       "testdata/envoy_bootstrap_v2.yaml",
+			servers:    []string{"unix:/var/run/xds.sock"},
+			apiVersion: _apiVersion2,
+		},
+		{file: "testdata/envoy_bootstrap_sds.yaml", err: true},
+		{file: "testdata/envoy_bootstrap_alts.yaml", err: true},
+		{file: "testdata/envoy_bootstrap_no_cluster.yaml", err: true},
+	}
+
+	for _, tt := range tests {
+		*_gFlags = globalFlags{envoyBootstrap: tt.file}
+		if tt.flags["servers"] != "" {
+			_gFlags.servers = []string{tt.flags["servers"]}
+		}
+		if tt.flags["delta"] != "" {
+			_gFlags.delta = true
+		}
+		err := applyEnvoyBootstrap(newBootstrapTestCommand(t, tt.flags))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.file)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(_gFlags.servers, tt.servers) {
+			t.Errorf("%s: servers are %v, expected %v", tt.file, _gFlags.servers, tt.servers)
+		}
+		if _gFlags.tls != tt.tls {
+			t.Errorf("%s: TLS options are %+v, expected %+v", tt.file, _gFlags.tls, tt.tls)
+		}
+		if !reflect.DeepEqual(_gFlags.bootstrapHeaders, tt.headers) {
+			t.Errorf("%s: headers are %v, expected %v", tt.file, _gFlags.bootstrapHeaders, tt.headers)
+		}
+		if _gFlags.xds.apiVersion != tt.apiVersion {
+			t.Errorf("%s: api version is %s, expected %s", tt.file, _gFlags.xds.apiVersion, tt.apiVersion)
+		}
+		if _gFlags.delta != tt.delta {
+			t.Errorf("%s: delta is %v, expected %v", tt.file, _gFlags.delta, tt.delta)
+		}
+		if id := _gFlags.xds.bootstrapNode.GetId(); id != tt.nodeID {
+			t.Errorf("%s: node id is %q, expected %q", tt.file, id, tt.nodeID)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	gcontext "context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// _authorizationHeader is the metadata that carries the bearer token.
+const _authorizationHeader = "authorization"
+
+// tokenCredentials attaches the bearer token to the streams. The token file is
+// read again for every stream, so that a rotated token is picked up when the
+// stream is reopened.
+type tokenCredentials struct {
+	token     string
+	tokenFile string
+	// plaintext allows the token to be sent without TLS.
+	plaintext bool
+}
+
+func (c *tokenCredentials) GetRequestMetadata(ctx gcontext.Context, uri ...string) (map[string]string, error) {
+	token := c.token
+	if c.tokenFile != "" {
+		data, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	return map[string]string{_authorizationHeader: "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity requires TLS unless the token is allowed in
+// plaintext, like for the port-forwarded control planes.
+func (c *tokenCredentials) RequireTransportSecurity() bool {
+	return !c.plaintext
+}
+
+// buildCallCredentials builds the per-RPC credentials from --token or
+// --token-file, it's nil if neither is specified. The token file is read once
+// here to report the error early.
+func buildCallCredentials(token, tokenFile string, plaintext bool) (credentials.PerRPCCredentials, error) {
+	switch {
+	case token != "" && tokenFile != "":
+		return nil, _errTokenConflict
+	case token != "":
+		return &tokenCredentials{token: token, plaintext: plaintext}, nil
+	case tokenFile != "":
+		if _, err := ioutil.ReadFile(tokenFile); err != nil {
+			return nil, err
+		}
+		return &tokenCredentials{tokenFile: tokenFile, plaintext: plaintext}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// buildTLSConfig builds the TLS config from the TLS flags, it's nil if none of
+// them is specified, and the connections are in plaintext then.
+func buildTLSConfig(flags *tlsFlags) (*tls.Config, error) {
+	if *flags == (tlsFlags{}) {
+		return nil, nil
+	}
+	if (flags.cert == "") != (flags.key == "") {
+		return nil, _errInvalidCertKeyPair
+	}
+
+	cfg := &tls.Config{
+		ServerName:         flags.serverName,
+		InsecureSkipVerify: flags.insecureSkipVerify,
+	}
+	if flags.cacert != "" {
+		pem, err := ioutil.ReadFile(flags.cacert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%v: no certificates in %s", _errInvalidCACert, flags.cacert)
+		}
+		cfg.RootCAs = pool
+	}
+	if flags.cert != "" {
+		cert, err := tls.LoadX509KeyPair(flags.cert, flags.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// _wildcardResourceName is the resource name that stands for all the resources
+// of the type.
+const _wildcardResourceName = "*"
+
+// deltaSubscription is the state of the resources of a type subscribed on the
+// delta stream.
+type deltaSubscription struct {
+	typeURL       string
+	resourceNames []string
+	// versions are the versions of the resources that the server sent.
+	versions map[string]string
+	received bool
+}
+
+// deltaProtocol is the incremental variant of the xDS protocol, it tracks the
+// version of every resource that the server sent.
+type deltaProtocol struct {
+	subscriptions map[string]*deltaSubscription
+	// order is the type urls in the order they were subscribed.
+	order []string
+	// unsubscribed are the types unsubscribed by the interactive commands,
+	// their late responses are ignored.
+	unsubscribed map[string]bool
+}
+
+func newDeltaProtocol(ctx *context) xdsProtocol {
+	p := &deltaProtocol{
+		subscriptions: make(map[string]*deltaSubscription, len(ctx.typeURLs)),
+		unsubscribed:  make(map[string]bool),
+	}
+	for _, typeURL := range ctx.typeURLs {
+		// The initial resource versions are only accepted with a single
+		// type.
+		versions := make(map[string]string, len(ctx.initialResourceVersions))
+		for name, version := range ctx.initialResourceVersions {
+			versions[name] = version
+		}
+		p.subscriptions[typeURL] = &deltaSubscription{
+			typeURL:       typeURL,
+			resourceNames: ctx.resourceNames[typeURL],
+			versions:      versions,
+		}
+		p.order = append(p.order, typeURL)
+	}
+	return p
+}
+
+func (p *deltaProtocol) openStream(ctx *context, conn *grpc.ClientConn) (grpc.ClientStream, error) {
+	return openDiscoveryStream(ctx, conn, true)
+}
+
+func (p *deltaProtocol) newResponse() proto.Message {
+	return &discoveryv3.DeltaDiscoveryResponse{}
+}
+
+func (p *deltaProtocol) initialRequests(ctx *context) []proto.Message {
+	var reqs []proto.Message
+	for _, typeURL := range p.order {
+		sub := p.subscriptions[typeURL]
+		reqs = append(reqs, &discoveryv3.DeltaDiscoveryRequest{
+			Node:                    makeNode(ctx),
+			TypeUrl:                 sub.typeURL,
+			ResourceNamesSubscribe:  sub.resourceNames,
+			InitialResourceVersions: sub.versions,
+		})
+	}
+	return reqs
+}
+
+func (p *deltaProtocol) handleResponse(ctx *context, msg proto.Message) (interface{}, []proto.Message, error) {
+	resp := msg.(*discoveryv3.DeltaDiscoveryResponse)
+	if p.unsubscribed[resp.GetTypeUrl()] {
+		verbosef(ctx, "IGNORE %s: the type was unsubscribed", resp.GetTypeUrl())
+		return nil, nil, nil
+	}
+	sub, ok := p.subscriptions[resp.GetTypeUrl()]
+	if !ok {
+		return nil, nil, fmt.Errorf("%v: %s", _errUnknownTypeUrl, resp.GetTypeUrl())
+	}
+	sub.received = true
+
+	ack := &discoveryv3.DeltaDiscoveryRequest{
+		TypeUrl:       sub.typeURL,
+		ResponseNonce: resp.GetNonce(),
+	}
+	if ctx.nackPolicy.reject(resp.GetTypeUrl(), resp.GetSystemVersionInfo()) {
+		// The rejected resources are not tracked.
+		ack.ErrorDetail = makeErrorDetail(ctx)
+		verbosef(ctx, "NACK %s: response_nonce=%q rejected_system_version_info=%q",
+			resp.GetTypeUrl(), resp.GetNonce(), resp.GetSystemVersionInfo())
+	} else {
+		for _, res := range resp.GetResources() {
+			sub.versions[res.GetName()] = res.GetVersion()
+		}
+		for _, name := range resp.GetRemovedResources() {
+			delete(sub.versions, name)
+		}
+		verbosef(ctx, "ACK %s: response_nonce=%q system_version_info=%q tracked_resources=%d",
+			resp.GetTypeUrl(), resp.GetNonce(), resp.GetSystemVersionInfo(), len(sub.versions))
+	}
+
+	out, err := convertToStructuredDeltaDiscoveryResponse(resp, sub.versions, ctx.flags.showSecrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, []proto.Message{ack}, nil
+}
+
+// editSubscription subscribes or unsubscribes the resource names of the type,
+// unsubscribing a type unsubscribes all its resource names, or the wildcard
+// "*" if it was subscribed without names.
+func (p *deltaProtocol) editSubscription(ctx *context, cmd *command) ([]proto.Message, error) {
+	req := &discoveryv3.DeltaDiscoveryRequest{TypeUrl: cmd.typeURL}
+	sub, ok := p.subscriptions[cmd.typeURL]
+	switch {
+	case cmd.kind == _commandSubscribe && !ok:
+		p.subscriptions[cmd.typeURL] = &deltaSubscription{
+			typeURL:       cmd.typeURL,
+			resourceNames: cmd.names,
+			versions:      make(map[string]string),
+		}
+		p.order = append(p.order, cmd.typeURL)
+		delete(p.unsubscribed, cmd.typeURL)
+		req.Node = makeNode(ctx)
+		req.ResourceNamesSubscribe = cmd.names
+	case cmd.kind == _commandSubscribe:
+		sub.resourceNames = mergeStrings(sub.resourceNames, cmd.names)
+		req.ResourceNamesSubscribe = cmd.names
+	case !ok:
+		return nil, nil
+	case len(cmd.names) == 0:
+		delete(p.subscriptions, cmd.typeURL)
+		p.order = removeStrings(p.order, []string{cmd.typeURL})
+		p.unsubscribed[cmd.typeURL] = true
+		req.ResourceNamesUnsubscribe = sub.resourceNames
+		if len(sub.resourceNames) == 0 {
+			req.ResourceNamesUnsubscribe = []string{_wildcardResourceName}
+		}
+	default:
+		sub.resourceNames = removeStrings(sub.resourceNames, cmd.names)
+		req.ResourceNamesUnsubscribe = cmd.names
+	}
+	return []proto.Message{req}, nil
+}
+
+func (p *deltaProtocol) synced() bool {
+	for _, sub := range p.subscriptions {
+		if !sub.received {
+			return false
+		}
+	}
+	return true
+}
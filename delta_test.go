@@ -0,0 +1,169 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+func TestDeltaProtocolVersionTracking(t *testing.T) {
+	policy, err := buildNackPolicy("version=^bad", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newSotwTestContext(policy, "cds")
+	ctx.initialResourceVersions = map[string]string{"c0": "0"}
+	cds := ctx.typeURLs[0]
+	p := newDeltaProtocol(ctx)
+
+	reqs := p.initialRequests(ctx)
+	if req := reqs[0].(*discoveryv3.DeltaDiscoveryRequest); !reflect.DeepEqual(req.GetInitialResourceVersions(), ctx.initialResourceVersions) {
+		t.Errorf("initial resource versions are %v, expected %v", req.GetInitialResourceVersions(), ctx.initialResourceVersions)
+	}
+
+	type resource struct {
+		name    string
+		version string
+	}
+	responses := []struct {
+		systemVersion string
+		nonce         string
+		resources     []resource
+		removed       []string
+		nack          bool
+		// versions are the tracked resource versions after the response.
+		versions map[string]string
+	}{
+		{
+			systemVersion: "1",
+			nonce:         "a",
+			resources:     []resource{{"c1", "1"}, {"c2", "1"}},
+			versions:      map[string]string{"c0": "0", "c1": "1", "c2": "1"},
+		},
+		{
+			systemVersion: "2",
+			nonce:         "b",
+			resources:     []resource{{"c1", "2"}},
+			removed:       []string{"c0"},
+			versions:      map[string]string{"c1": "2", "c2": "1"},
+		},
+		{
+			// The rejected resources are not tracked.
+			systemVersion: "bad-3",
+			nonce:         "c",
+			resources:     []resource{{"c3", "3"}},
+			removed:       []string{"c2"},
+			nack:          true,
+			versions:      map[string]string{"c1": "2", "c2": "1"},
+		},
+		{
+			systemVersion: "4",
+			nonce:         "d",
+			removed:       []string{"c2", "c9"},
+			versions:      map[string]string{"c1": "2"},
+		},
+	}
+	for _, r := range responses {
+		resp := &discoveryv3.DeltaDiscoveryResponse{
+			TypeUrl:           cds,
+			SystemVersionInfo: r.systemVersion,
+			Nonce:             r.nonce,
+			RemovedResources:  r.removed,
+		}
+		for _, res := range r.resources {
+			cluster, err := ptypes.MarshalAny(&clusterv3.Cluster{Name: res.name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Resources = append(resp.Resources, &discoveryv3.Resource{
+				Name:     res.name,
+				Version:  res.version,
+				Resource: cluster,
+			})
+		}
+
+		_, reqs, err := p.handleResponse(ctx, resp)
+		if err != nil {
+			t.Fatalf("system version %s: %v", r.systemVersion, err)
+		}
+		if len(reqs) != 1 {
+			t.Fatalf("system version %s: %d requests, expected 1", r.systemVersion, len(reqs))
+		}
+		req := reqs[0].(*discoveryv3.DeltaDiscoveryRequest)
+		if req.GetResponseNonce() != r.nonce {
+			t.Errorf("system version %s: request nonce is %q, expected %q", r.systemVersion, req.GetResponseNonce(), r.nonce)
+		}
+		if nack := req.GetErrorDetail() != nil; nack != r.nack {
+			t.Errorf("system version %s: NACK is %v, expected %v", r.systemVersion, nack, r.nack)
+		}
+		if versions := p.(*deltaProtocol).subscriptions[cds].versions; !reflect.DeepEqual(versions, r.versions) {
+			t.Errorf("system version %s: versions are %v, expected %v", r.systemVersion, versions, r.versions)
+		}
+	}
+
+	// The reopened stream tells the server the tracked versions.
+	reqs = p.initialRequests(ctx)
+	want := map[string]string{"c1": "2"}
+	if req := reqs[0].(*discoveryv3.DeltaDiscoveryRequest); !reflect.DeepEqual(req.GetInitialResourceVersions(), want) {
+		t.Errorf("reopened initial resource versions are %v, expected %v", req.GetInitialResourceVersions(), want)
+	}
+}
+
+func TestDeltaProtocolEditSubscription(t *testing.T) {
+	tests := []struct {
+		line        string
+		names       []string
+		subscribe   []string
+		unsubscribe []string
+	}{
+		{line: "+cds c2", names: []string{"c1"}, subscribe: []string{"c2"}},
+		{line: "-cds c1", names: []string{"c1", "c2"}, unsubscribe: []string{"c1"}},
+		{line: "-cds", names: []string{"c1", "c2"}, unsubscribe: []string{"c1", "c2"}},
+		// The wildcard subscription is unsubscribed by its special name.
+		{line: "-cds", unsubscribe: []string{"*"}},
+	}
+
+	for _, tt := range tests {
+		ctx := newSotwTestContext(&noneNackPolicy{}, "cds")
+		ctx.resourceNames[ctx.typeURLs[0]] = tt.names
+		p := newDeltaProtocol(ctx)
+
+		cmd, err := parseCommand(_apiVersion3, tt.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs, err := p.editSubscription(ctx, cmd)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if len(reqs) != 1 {
+			t.Errorf("%q: %d requests, expected 1", tt.line, len(reqs))
+			continue
+		}
+		req := reqs[0].(*discoveryv3.DeltaDiscoveryRequest)
+		if !reflect.DeepEqual(req.GetResourceNamesSubscribe(), tt.subscribe) ||
+			!reflect.DeepEqual(req.GetResourceNamesUnsubscribe(), tt.unsubscribe) {
+			t.Errorf("%q: subscribe %v and unsubscribe %v, expected %v and %v", tt.line,
+				req.GetResourceNamesSubscribe(), req.GetResourceNamesUnsubscribe(), tt.subscribe, tt.unsubscribe)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	hcmv2 "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+// rdsResourceNames collects the route config names of the HTTP connection
+// managers that fetch the routes through RDS. Only the typed_config of the
+// filters is inspected.
+func rdsResourceNames(resources []*any.Any) ([]string, error) {
+	names := make(map[string]struct{})
+	for _, item := range resources {
+		res, err := _resourceTypes.decode(item)
+		if err != nil {
+			return nil, err
+		}
+
+		switch listener := res.(type) {
+		case *apiv2.Listener:
+			for _, chain := range listener.GetFilterChains() {
+				for _, filter := range chain.GetFilters() {
+					hcm := &hcmv2.HttpConnectionManager{}
+					if !ptypes.Is(filter.GetTypedConfig(), hcm) {
+						continue
+					}
+					if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), hcm); err != nil {
+						return nil, err
+					}
+					if name := hcm.GetRds().GetRouteConfigName(); name != "" {
+						names[name] = struct{}{}
+					}
+				}
+			}
+		case *listenerv3.Listener:
+			for _, chain := range listener.GetFilterChains() {
+				for _, filter := range chain.GetFilters() {
+					hcm := &hcmv3.HttpConnectionManager{}
+					if !ptypes.Is(filter.GetTypedConfig(), hcm) {
+						continue
+					}
+					if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), hcm); err != nil {
+						return nil, err
+					}
+					if name := hcm.GetRds().GetRouteConfigName(); name != "" {
+						names[name] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+	return sortedKeys(names), nil
+}
+
+// edsResourceNames collects the EDS resource names of the EDS clusters, which
+// is the service_name in the EDS cluster config, or the cluster name if it's
+// absent.
+func edsResourceNames(resources []*any.Any) ([]string, error) {
+	names := make(map[string]struct{})
+	for _, item := range resources {
+		res, err := _resourceTypes.decode(item)
+		if err != nil {
+			return nil, err
+		}
+
+		switch cluster := res.(type) {
+		case *apiv2.Cluster:
+			if cluster.GetType() != apiv2.Cluster_EDS {
+				continue
+			}
+			if name := cluster.GetEdsClusterConfig().GetServiceName(); name != "" {
+				names[name] = struct{}{}
+			} else {
+				names[cluster.GetName()] = struct{}{}
+			}
+		case *clusterv3.Cluster:
+			if cluster.GetType() != clusterv3.Cluster_EDS {
+				continue
+			}
+			if name := cluster.GetEdsClusterConfig().GetServiceName(); name != "" {
+				names[name] = struct{}{}
+			} else {
+				names[cluster.GetName()] = struct{}{}
+			}
+		}
+	}
+	return sortedKeys(names), nil
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	gcontext "context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	_proxySchemeHTTP   = "http"
+	_proxySchemeSOCKS5 = "socks5"
+)
+
+// dial connects to the endpoint, which is either a TCP address or a unix
+// domain socket. The TCP connections are tunneled through the --proxy if any.
+func dial(ctx *context, dialCtx gcontext.Context, addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, _unixScheme+":") {
+		return (&net.Dialer{}).DialContext(dialCtx, "unix", strings.TrimPrefix(addr, _unixScheme+":"))
+	}
+
+	switch {
+	case ctx.proxyURL == nil:
+		return (&net.Dialer{}).DialContext(dialCtx, "tcp", addr)
+	case ctx.proxyURL.Scheme == _proxySchemeSOCKS5:
+		return dialSOCKS5(dialCtx, ctx.proxyURL, addr)
+	default:
+		return dialHTTPConnect(dialCtx, ctx.proxyURL, addr)
+	}
+}
+
+func dialSOCKS5(ctx gcontext.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, &net.Dialer{})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+// dialHTTPConnect opens the tunnel to the address with the HTTP CONNECT
+// method.
+func dialHTTPConnect(ctx gcontext.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", addr, resp.Status)
+	}
+
+	// The server may speak first, its data can be buffered with the
+	// response.
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn reads the data buffered by the reader before the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// buildProxyURL parses the --proxy value, which is like
+// http://[user:password@]host:port or socks5://[user:password@]host:port.
+func buildProxyURL(value string) (*url.URL, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", _errInvalidProxy, err)
+	}
+	if proxyURL.Scheme != _proxySchemeHTTP && proxyURL.Scheme != _proxySchemeSOCKS5 {
+		return nil, fmt.Errorf("%v: unsupported scheme %s", _errInvalidProxy, proxyURL.Scheme)
+	}
+	if proxyURL.Port() == "" {
+		return nil, fmt.Errorf("%v: no port", _errInvalidProxy)
+	}
+	return proxyURL, nil
+}
+
+// dialRecorder keeps the last error of the connection attempts, since gRPC
+// only reports the timeout of a blocking dial if the error is temporary, like
+// the handshake failures.
+type dialRecorder struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (r *dialRecorder) record(err error) error {
+	if err != nil {
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *dialRecorder) lastError() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// recordingCredentials records the handshake errors of the credentials.
+type recordingCredentials struct {
+	credentials.TransportCredentials
+	recorder *dialRecorder
+}
+
+func (c *recordingCredentials) ClientHandshake(ctx gcontext.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, conn)
+	return conn, info, c.recorder.record(err)
+}
+
+func (c *recordingCredentials) Clone() credentials.TransportCredentials {
+	return &recordingCredentials{
+		TransportCredentials: c.TransportCredentials.Clone(),
+		recorder:             c.recorder,
+	}
+}
@@ -17,208 +17,417 @@ package main
 import (
 	gcontext "context"
 	"fmt"
+	"math"
 	"math/rand"
 	"net"
+	"os"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 
-	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	discoveryv2 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 )
 
 var (
 	_xdsUserAgentName = "xdscli/" + _version
 )
 
+const (
+	_closeStreamTimeout = time.Second
+	// _minConnectTimeout is the gRPC default, which is dropped once the
+	// backoff is configured.
+	_minConnectTimeout = 20 * time.Second
+
+	// The backoff of the stream reconnects follows the gRPC connection
+	// backoff, only the delays are configurable.
+	_backoffMultiplier = 1.6
+	_backoffJitter     = 0.2
+)
+
+// streamError is the error of the connection or the stream, which is
+// recovered by reconnecting in watch mode.
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string {
+	return e.err.Error()
+}
+
 type mediateSuite struct {
 	errc  chan error
-	ackc  chan string
 	stopc chan struct{}
-	respc chan *apiv2.DiscoveryResponse
+	respc chan proto.Message
+	// cmdc receives the interactive commands, it's nil if not in the
+	// interactive mode.
+	cmdc chan string
+}
+
+// xdsProtocol is the variant of the xDS protocol spoken on the stream, either
+// the state of the world one or the incremental (delta) one.
+type xdsProtocol interface {
+	// openStream opens the discovery stream on the connection.
+	openStream(ctx *context, conn *grpc.ClientConn) (grpc.ClientStream, error)
+	// newResponse allocates a response message to receive.
+	newResponse() proto.Message
+	// initialRequests makes the requests sent once the stream is opened.
+	initialRequests(ctx *context) []proto.Message
+	// handleResponse converts the response to the structured output, which
+	// is nil if nothing should be printed, and makes the requests to send
+	// back, like the ACK.
+	handleResponse(ctx *context, resp proto.Message) (interface{}, []proto.Message, error)
+	// synced reports whether every subscription was responded.
+	synced() bool
+	// editSubscription applies the interactive command to the
+	// subscriptions and makes the requests for the changes, the commands
+	// that the protocol can't express are refused.
+	editSubscription(ctx *context, cmd *command) ([]proto.Message, error)
 }
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func newGRPCConn(ctx *context) (*grpc.ClientConn, error) {
+func newGRPCConn(ctx *context, ep endpoint) (*grpc.ClientConn, error) {
 	dialCtx, dialCancel := gcontext.WithTimeout(ctx.rootCtx, ctx.flags.dialTimeout)
 	defer dialCancel()
 
+	recorder := &dialRecorder{}
 	dialOpts := grpc.WithContextDialer(
-		func(ctx gcontext.Context, addr string) (net.Conn, error) {
-			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		func(dialCtx gcontext.Context, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, dialCtx, addr)
+			return conn, recorder.record(err)
 		},
 	)
 
+	// The :authority is the server target that the address was resolved
+	// from, unless --authority is specified.
+	authority := ep.authority
+	if ctx.flags.authority != "" {
+		authority = ctx.flags.authority
+	}
+
 	kp := keepalive.ClientParameters{
-		Time:                30 * time.Second,
-		Timeout:             2 * time.Second,
-		PermitWithoutStream: true,
+		Time:                ctx.flags.keepaliveTime,
+		Timeout:             ctx.flags.keepaliveTimeout,
+		PermitWithoutStream: ctx.flags.keepalivePermitWithoutStream,
 	}
 
-	addr := ctx.endpoints[rand.Intn(len(ctx.endpoints))]
-	// TODO TLS support
-	conn, err := grpc.DialContext(dialCtx, addr,
-		grpc.WithInsecure(),
+	bc := backoff.DefaultConfig
+	bc.BaseDelay = ctx.flags.backoffBaseDelay
+	bc.MaxDelay = ctx.flags.backoffMaxDelay
+
+	transportOpt := grpc.WithInsecure()
+	if ctx.tlsConfig != nil {
+		// gRPC verifies the certificate against the dialed address rather
+		// than the :authority, so the server name defaults to the host of
+		// the authority, unless --server-name is specified.
+		tlsConfig := ctx.tlsConfig
+		if tlsConfig.ServerName == "" && authority != "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = authority
+			if host, _, err := net.SplitHostPort(authority); err == nil {
+				tlsConfig.ServerName = host
+			}
+		}
+		transportOpt = grpc.WithTransportCredentials(&recordingCredentials{
+			TransportCredentials: credentials.NewTLS(tlsConfig),
+			recorder:             recorder,
+		})
+	}
+
+	opts := []grpc.DialOption{
+		transportOpt,
 		dialOpts,
 		grpc.WithBlock(),
+		// Report the handshake failures, like the certificate errors,
+		// rather than the dial timeout.
+		grpc.FailOnNonTempDialError(true),
 		grpc.WithKeepaliveParams(kp),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(ctx.flags.grpcMaxCallRecvSize)))
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: bc, MinConnectTimeout: _minConnectTimeout}),
+		grpc.WithInitialWindowSize(ctx.flags.initialWindowSize),
+		grpc.WithInitialConnWindowSize(ctx.flags.initialConnWindowSize),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(ctx.flags.grpcMaxCallRecvSize)),
+	}
+	if ctx.callCreds != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(ctx.callCreds))
+	}
+
+	if authority != "" {
+		opts = append(opts, grpc.WithAuthority(authority))
+	}
+	conn, err := grpc.DialContext(dialCtx, ep.addr, opts...)
 
 	if err != nil {
+		if lastErr := recorder.lastError(); lastErr != nil && err == gcontext.DeadlineExceeded {
+			return nil, fmt.Errorf("%v: %v", err, lastErr)
+		}
 		return nil, err
 	}
 
 	return conn, nil
 }
 
-func doDiscoveryService(ctx *context) error {
-	conn, err := newGRPCConn(ctx)
+func newXDSProtocol(ctx *context) xdsProtocol {
+	if ctx.flags.delta {
+		return newDeltaProtocol(ctx)
+	}
+	return newSotwProtocol(ctx)
+}
+
+// doDiscoveryService runs the protocol on the stream. In watch mode, the
+// broken stream is reopened after a backoff, on the next endpoint, until it's
+// interrupted.
+func doDiscoveryService(ctx *context, protocol xdsProtocol) error {
+	defer ctx.rootCancel()
+
+	var cmdc chan string
+	if ctx.flags.interactive {
+		cmdc = make(chan string)
+		go commandThread(os.Stdin, cmdc, ctx.rootCtx.Done())
+	}
+
+	start := rand.Intn(len(ctx.endpoints))
+	attempt := 0
+	for i := 0; ; i++ {
+		ep := ctx.endpoints[(start+i)%len(ctx.endpoints)]
+		if i > 0 {
+			fmt.Fprintf(os.Stderr, "Reconnecting to %s\n", ep.addr)
+		}
+
+		received, err := runStream(ctx, protocol, ep, cmdc)
+		serr, ok := err.(*streamError)
+		if !ok {
+			return err
+		}
+		if !ctx.flags.watch {
+			return serr.err
+		}
+		if received {
+			// The stream worked for a while, start over the backoff.
+			attempt = 0
+		}
+
+		delay := reconnectDelay(ctx, attempt)
+		attempt++
+		fmt.Fprintf(os.Stderr, "Lost %s, reconnecting in %v: %v\n", ep.addr, delay.Round(time.Millisecond), serr.err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.interc:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// reconnectDelay is the exponential backoff delay of the nth reconnect in a
+// row, with a random jitter.
+func reconnectDelay(ctx *context, attempt int) time.Duration {
+	delay := float64(ctx.flags.backoffBaseDelay) * math.Pow(_backoffMultiplier, float64(attempt))
+	if delay > float64(ctx.flags.backoffMaxDelay) {
+		delay = float64(ctx.flags.backoffMaxDelay)
+	}
+	delay *= 1 + _backoffJitter*(rand.Float64()*2-1)
+	return time.Duration(delay)
+}
+
+// runStream opens the stream to the endpoint and runs the protocol on it until
+// it's interrupted, synced in one-shot mode, or broken. The errors of the
+// connection and the stream are returned as *streamError. It also reports
+// whether any response was received on the stream.
+func runStream(ctx *context, protocol xdsProtocol, ep endpoint, cmdc chan string) (bool, error) {
+	conn, err := newGRPCConn(ctx, ep)
 	if err != nil {
-		return err
+		return false, &streamError{err: err}
 	}
 
-	adsClient, err := discoveryv2.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx.rootCtx)
+	stream, err := protocol.openStream(ctx, conn)
 	if err != nil {
-		return err
+		conn.Close()
+		return false, &streamError{err: err}
 	}
 
 	suite := &mediateSuite{
 		errc:  make(chan error, 1),
 		stopc: make(chan struct{}),
-		ackc:  make(chan string, 1),
-		respc: make(chan *apiv2.DiscoveryResponse, 1),
+		respc: make(chan proto.Message, 1),
+		cmdc:  cmdc,
 	}
 
-	ctx.wg.Add(2)
+	ctx.wg.Add(1)
 
-	go receiveThread(ctx, adsClient, suite)
-	go sendThread(ctx, adsClient, suite)
+	go receiveThread(ctx, stream, protocol, suite)
 
 	finalize := func() {
 		close(suite.stopc)
-		ctx.rootCancel()
 		conn.Close()
 		ctx.wg.Wait()
 	}
+	defer finalize()
+
+	for _, req := range protocol.initialRequests(ctx) {
+		if err := sendMsg(ctx, conn, stream, req); err != nil {
+			return false, &streamError{err: err}
+		}
+	}
+
+	// The read timeout bounds the wait for each response until every
+	// subscription is responded.
+	var readTimer *time.Timer
+	var readc <-chan time.Time
+	if ctx.flags.readTimeout > 0 {
+		readTimer = time.NewTimer(ctx.flags.readTimeout)
+		defer readTimer.Stop()
+		readc = readTimer.C
+	}
 
+	received := false
 	for {
 		select {
 		case <-ctx.interc:
-			finalize()
-			return nil
+			return received, nil
 		case err := <-suite.errc:
-			finalize()
-			return err
+			return received, &streamError{err: err}
+		case <-readc:
+			return received, &streamError{err: _errReadTimeout}
 		case resp := <-suite.respc:
-			data, err := ctx.marshaller.marshal(resp)
+			received = true
+			if readTimer != nil && !readTimer.Stop() {
+				// Drop the expiry racing with the response.
+				select {
+				case <-readTimer.C:
+				default:
+				}
+			}
+			out, reqs, err := protocol.handleResponse(ctx, resp)
 			if err != nil {
-				panic(err)
+				return received, err
 			}
-			fmt.Println(data)
-			if !ctx.flags.watch {
-				finalize()
-				return nil
+			if out != nil {
+				data, err := ctx.marshaller.marshal(out)
+				if err != nil {
+					return received, err
+				}
+				fmt.Println(data)
+			}
+			for _, req := range reqs {
+				if err := sendMsg(ctx, conn, stream, req); err != nil {
+					return received, &streamError{err: err}
+				}
+			}
+			if !ctx.flags.watch && protocol.synced() {
+				closeStream(stream, suite)
+				return received, nil
+			}
+			if readTimer != nil && !protocol.synced() {
+				readTimer.Reset(ctx.flags.readTimeout)
+			} else {
+				readc = nil
+			}
+		case line := <-suite.cmdc:
+			for _, req := range handleCommand(ctx, protocol, line) {
+				if err := sendMsg(ctx, conn, stream, req); err != nil {
+					return received, &streamError{err: err}
+				}
 			}
 		}
 	}
-
-	return nil
 }
 
-func receiveThread(ctx *context, adsClient discoveryv2.AggregatedDiscoveryService_StreamAggregatedResourcesClient, suite *mediateSuite) {
-	defer ctx.wg.Done()
+// sendMsg sends the request on the stream, the connection is closed to abort
+// the send if it's blocked longer than the --send-timeout.
+func sendMsg(ctx *context, conn *grpc.ClientConn, stream grpc.ClientStream, req proto.Message) error {
+	if ctx.flags.sendTimeout == 0 {
+		return stream.SendMsg(req)
+	}
 
-	resp, err := adsClient.Recv()
-	if err != nil {
-		suite.errc <- err
-		select {
-		case <-suite.stopc:
-			return
-		}
+	timer := time.AfterFunc(ctx.flags.sendTimeout, func() {
+		conn.Close()
+	})
+	err := stream.SendMsg(req)
+	if !timer.Stop() {
+		return _errSendTimeout
 	}
+	return err
+}
 
-	nonce := resp.Nonce
-	suite.ackc <- nonce
-	suite.respc <- resp
+// recvMsg receives the response from the stream, the connection is closed to
+// abort the receive if no response arrives within the --read-timeout.
+func recvMsg(ctx *context, conn *grpc.ClientConn, stream grpc.ClientStream, resp proto.Message) error {
+	if ctx.flags.readTimeout == 0 {
+		return stream.RecvMsg(resp)
+	}
 
-	if !ctx.flags.watch {
+	timer := time.AfterFunc(ctx.flags.readTimeout, func() {
+		conn.Close()
+	})
+	err := stream.RecvMsg(resp)
+	if !timer.Stop() {
+		return _errReadTimeout
+	}
+	return err
+}
+
+// closeStream half-closes the stream and waits a while for the server to end
+// it, so that the last ACK or NACK isn't dropped by the cancellation.
+func closeStream(stream grpc.ClientStream, suite *mediateSuite) {
+	if err := stream.CloseSend(); err != nil {
 		return
 	}
 
+	timer := time.NewTimer(_closeStreamTimeout)
+	defer timer.Stop()
+
 	for {
-		resp, err := adsClient.Recv()
-		if err != nil {
-			suite.errc <- err
-			select {
-			case <-suite.stopc:
-				return
-			}
+		select {
+		case <-suite.respc:
+		case <-suite.errc:
+			return
+		case <-timer.C:
+			return
 		}
-
-		nonce := resp.Nonce
-		suite.ackc <- nonce
-		suite.respc <- resp
 	}
 }
 
-func sendThread(ctx *context, adsClient discoveryv2.AggregatedDiscoveryService_StreamAggregatedResourcesClient, suite *mediateSuite) {
+// receiveThread pumps the responses from the stream until it's broken.
+func receiveThread(ctx *context, stream grpc.ClientStream, protocol xdsProtocol, suite *mediateSuite) {
 	defer ctx.wg.Done()
 
-	node := makeNode(ctx)
-	// TODO Get ResourceName by spawning another CDS request when type url is
-	// EDS and ResourceName is empty.
-	discReq := makeDiscoveryRequest(ctx, node, ctx.flags.xds.resourceNames, "")
-	if err := adsClient.Send(discReq); err != nil {
-		suite.errc <- err
-		select {
-		case <-suite.stopc:
+	for {
+		resp := protocol.newResponse()
+		if err := stream.RecvMsg(resp); err != nil {
+			select {
+			case suite.errc <- err:
+			case <-suite.stopc:
+			}
 			return
 		}
-	}
 
-	for {
 		select {
+		case suite.respc <- resp:
 		case <-suite.stopc:
 			return
-		case nonce := <-suite.ackc:
-			// Send the ack.
-			discReq = makeDiscoveryRequest(ctx, makeNode(ctx), nil, nonce)
-			if err := adsClient.Send(discReq); err != nil {
-				suite.errc <- err
-				select {
-				case <-suite.stopc:
-					return
-				}
-			}
-			if !ctx.flags.watch {
-				return
-			}
 		}
 	}
 }
 
-func makeDiscoveryRequest(ctx *context, node *core.Node, resourceNames []string, nonce string) *apiv2.DiscoveryRequest {
-	discReq := &apiv2.DiscoveryRequest{
-		VersionInfo:   ctx.flags.xds.initialVersionInfo,
-		Node:          node,
-		ResourceNames: resourceNames,
-		TypeUrl:       ctx.typeUrl,
-		// ErrorDetail: ctx.flags.xds.errorDetail,
-		ResponseNonce: nonce,
+// makeNode makes the node from the options, the node in the bootstrap file is
+// taken as the base if any.
+func makeNode(ctx *context) *corev3.Node {
+	node := &corev3.Node{}
+	if base := ctx.flags.xds.bootstrapNode; base != nil {
+		node = proto.Clone(base).(*corev3.Node)
 	}
-	return discReq
-}
-
-func makeNode(ctx *context) *core.Node {
-	node := &core.Node{
-		Id:            ctx.flags.xds.node,
-		Metadata:      ctx.nodeMeta,
-		UserAgentName: _xdsUserAgentName,
+	node.Id = ctx.flags.xds.node
+	if ctx.nodeMeta != nil {
+		node.Metadata = ctx.nodeMeta
 	}
+	node.UserAgentName = _xdsUserAgentName
 	return node
 }
@@ -0,0 +1,126 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// dumpProtocol fetches the resources like a warming Envoy, the listeners are
+// fetched first, then the routes referenced by the listeners, the clusters,
+// and the endpoints of the clusters at last, all on the same ADS stream.
+type dumpProtocol struct {
+	*sotwProtocol
+
+	// responses are the latest accepted responses of each type.
+	responses map[string]*discoveryResponse
+	// accepted are the resources of the latest accepted responses, which
+	// the dependent resources are collected from.
+	accepted map[string][]*any.Any
+}
+
+func newDumpProtocol(ctx *context) xdsProtocol {
+	p := &dumpProtocol{
+		sotwProtocol: &sotwProtocol{
+			subscriptions:  make(map[string]*subscription),
+			unsubscribed:   make(map[string]bool),
+			initialVersion: ctx.flags.xds.initialVersionInfo,
+		},
+		responses: make(map[string]*discoveryResponse),
+		accepted:  make(map[string][]*any.Any),
+	}
+	p.subscribe(_typeURLMap[ctx.flags.xds.apiVersion]["lds"], nil)
+	return p
+}
+
+func (p *dumpProtocol) handleResponse(ctx *context, msg proto.Message) (interface{}, []proto.Message, error) {
+	resp := msg.(*discoveryv3.DiscoveryResponse)
+	if p.ignored(ctx, resp.GetTypeUrl()) {
+		return nil, nil, nil
+	}
+	sub, ack, err := p.ack(ctx, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	reqs := []proto.Message{ack}
+
+	// Like Envoy, the rejected resources are not used, the dependencies
+	// are still fetched for the last accepted ones, so that the dump goes
+	// on.
+	if !sub.rejected {
+		out, err := convertToStructuredDiscoveryResponse(resp, ctx.flags.showSecrets)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.responses[sub.typeURL] = out
+		p.accepted[sub.typeURL] = resp.GetResources()
+	}
+	resources := p.accepted[sub.typeURL]
+
+	typeURLs := _typeURLMap[ctx.flags.xds.apiVersion]
+	switch sub.typeURL {
+	case typeURLs["lds"]:
+		names, err := rdsResourceNames(resources)
+		if err != nil {
+			return nil, nil, err
+		}
+		if req := p.resubscribe(ctx, typeURLs["rds"], names); req != nil {
+			reqs = append(reqs, req)
+		}
+		if _, ok := p.subscriptions[typeURLs["rds"]]; !ok {
+			// No routes to wait for.
+			reqs = append(reqs, p.subscribeClusters(ctx)...)
+		}
+	case typeURLs["rds"]:
+		reqs = append(reqs, p.subscribeClusters(ctx)...)
+	case typeURLs["cds"]:
+		names, err := edsResourceNames(resources)
+		if err != nil {
+			return nil, nil, err
+		}
+		if req := p.resubscribe(ctx, typeURLs["eds"], names); req != nil {
+			reqs = append(reqs, req)
+		}
+	}
+
+	if !p.synced() {
+		return nil, reqs, nil
+	}
+
+	dump := &configDump{}
+	for typeURL, section := range map[string]*discoveryResponse{
+		typeURLs["lds"]: &dump.Listeners,
+		typeURLs["rds"]: &dump.Routes,
+		typeURLs["cds"]: &dump.Clusters,
+		typeURLs["eds"]: &dump.Endpoints,
+	} {
+		if resp, ok := p.responses[typeURL]; ok {
+			*section = *resp
+		}
+	}
+	return dump, reqs, nil
+}
+
+// subscribeClusters subscribes all the clusters once.
+func (p *dumpProtocol) subscribeClusters(ctx *context) []proto.Message {
+	typeURL := _typeURLMap[ctx.flags.xds.apiVersion]["cds"]
+	if _, ok := p.subscriptions[typeURL]; ok {
+		return nil
+	}
+	return []proto.Message{makeDiscoveryRequest(ctx, p.subscribe(typeURL, nil), nil)}
+}
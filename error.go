@@ -24,22 +24,60 @@ const (
 	// http://tldp.org/LDP/abs/html/exitcodes.html
 	_exitSuccess = iota
 	_exitError
+	_exitInconsistent
 
+	// _exitTimeout follows the timeout command.
+	_exitTimeout = 124
 	_exitBadArgs = 128
 )
 
 var (
-	_errNoServers                  = errors.New("no servers")
-	_errInvalidDialTimeout         = errors.New("invalid --dial-timeout value")
-	_errInvalidReadTimeout         = errors.New("invalid --read-timeout value")
-	_errInvalidSendTimeout         = errors.New("invalid --send-timeout value")
-	_errInvalidOutputFormat        = errors.New("invalid --write-out value")
-	_errInvalidNode                = errors.New("invalid --node value")
-	_errInvalidNodeMetaFormat      = errors.New("invalid --node-metadata value")
-	_errInvalidGRPCMaxCallRecvSize = errors.New("invalid --grpc-max-call-recv-size")
-	_errUnknownTypeUrl             = errors.New("server sent unknown resource type url")
+	_errNoServers                      = errors.New("no servers")
+	_errInvalidServer                  = errors.New("invalid --servers value")
+	_errInvalidResolver                = errors.New("invalid --resolver value")
+	_errInvalidProxy                   = errors.New("invalid --proxy value")
+	_errInvalidDialTimeout             = errors.New("invalid --dial-timeout value")
+	_errInvalidReadTimeout             = errors.New("invalid --read-timeout value")
+	_errInvalidSendTimeout             = errors.New("invalid --send-timeout value")
+	_errInvalidKeepalive               = errors.New("invalid --keepalive-time or --keepalive-timeout value")
+	_errInvalidBackoff                 = errors.New("invalid --backoff-base-delay or --backoff-max-delay value")
+	_errInvalidWindowSize              = errors.New("invalid --initial-window-size or --initial-conn-window-size value")
+	_errInvalidOutputFormat            = errors.New("invalid --write-out value")
+	_errInvalidIndent                  = errors.New("invalid --indent value")
+	_errInvalidTransport               = errors.New("invalid --transport value")
+	_errInvalidNode                    = errors.New("invalid --node value")
+	_errInvalidNodeMetaFormat          = errors.New("invalid --node-metadata value")
+	_errInvalidGRPCMaxCallRecvSize     = errors.New("invalid --grpc-max-call-recv-size")
+	_errInvalidInitialResourceVersions = errors.New("invalid --initial-resource-versions value")
+	_errInvalidNackPolicy              = errors.New("invalid --nack-policy value")
+	_errInvalidCertKeyPair             = errors.New("--cert and --key must be specified together")
+	_errInvalidCACert                  = errors.New("invalid --cacert value")
+	_errTokenConflict                  = errors.New("--token and --token-file are mutually exclusive")
+	_errTokenNeedsTLS                  = errors.New("--token and --token-file require TLS, unless the servers are local or --plaintext-token is specified")
+	_errInvalidHeader                  = errors.New("invalid --header value")
+	_errInvalidResourceNames           = errors.New("invalid --resource-names value")
+	_errFanOutConflict                 = errors.New("--fan-out only works with the one-shot state of the world protocol")
+	_errInvalidBootstrap               = errors.New("invalid --bootstrap file")
+	_errInvalidEnvoyBootstrap          = errors.New("invalid --envoy-bootstrap file")
+	_errBootstrapConflict              = errors.New("--bootstrap and --envoy-bootstrap are mutually exclusive")
+	_errDumpNeedsADS                   = errors.New("dump only works with the state of the world ADS transport")
+	_errMultipleTypesNeedADS           = errors.New("multiple resource types can only be subscribed through the ADS transport")
+	_errInteractiveNeedsWatch          = errors.New("--interactive is only valid with --watch")
+	_errInvalidCommand                 = errors.New("invalid command")
+	_errWildcardUnsubscribe            = errors.New("the listeners and clusters can't all be unsubscribed with the state of the world protocol, the empty resource names subscribe all of them")
+	_errReadTimeout                    = errors.New("no response within the --read-timeout")
+	_errSendTimeout                    = errors.New("request not sent within the --send-timeout")
+	_errUnknownTypeUrl                 = errors.New("server sent unknown resource type url")
 )
 
+// exitCode is the exit code of the error, the timeouts have their own code.
+func exitCode(err error) int {
+	if err == _errReadTimeout || err == _errSendTimeout {
+		return _exitTimeout
+	}
+	return _exitError
+}
+
 func exitWithError(code int, err error) {
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
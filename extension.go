@@ -0,0 +1,57 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The extensions are linked in so that their typed configs nested in the
+// resources are expanded in the output, a new extension can be supported by
+// importing its package here.
+import (
+	_ "github.com/cncf/udpa/go/udpa/type/v1"
+
+	// xDS v2
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/cors/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/ext_authz/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/fault/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/grpc_web/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/jwt_authn/v2alpha"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/lua/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rbac/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/router/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/listener/http_inspector/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/listener/original_dst/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/listener/tls_inspector/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/ext_authz/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/rbac/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+
+	// xDS v3
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/fault/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_web/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/http_inspector/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/original_dst/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/ext_authz/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/rbac/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+)
@@ -0,0 +1,324 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+const (
+	_inconsistencyVersion  = "version"
+	_inconsistencyResource = "resource"
+
+	// _missing marks the resource that a replica doesn't have.
+	_missing = "<missing>"
+
+	// _fanOutReadTimeout is the --read-timeout of the replicas if it's not
+	// specified, so that a replica that never responds is reported rather
+	// than blocking the report.
+	_fanOutReadTimeout = 10 * time.Second
+)
+
+// replicaResult is the latest response of each type that a replica sent.
+type replicaResult struct {
+	endpoint  string
+	err       error
+	responses map[string]*discoveryv3.DiscoveryResponse
+}
+
+// fanOutReport is the summary of every replica and the differences between
+// them.
+type fanOutReport struct {
+	Consistent      bool             `json:"consistent" yaml:"consistent"`
+	Replicas        []replicaSummary `json:"replicas" yaml:"replicas"`
+	Inconsistencies []inconsistency  `json:"inconsistencies,omitempty" yaml:"inconsistencies,omitempty"`
+}
+
+type replicaSummary struct {
+	Endpoint string        `json:"endpoint" yaml:"endpoint"`
+	Error    string        `json:"error,omitempty" yaml:"error,omitempty"`
+	Types    []typeSummary `json:"types,omitempty" yaml:"types,omitempty"`
+}
+
+type typeSummary struct {
+	TypeUrl     string `json:"type_url" yaml:"type_url"`
+	VersionInfo string `json:"version_info" yaml:"version_info"`
+	Resources   int    `json:"resources" yaml:"resources"`
+}
+
+// inconsistency is a version or a resource that differs between the
+// replicas, the replicas are mapped to the version, or to the fingerprint of
+// the resource.
+type inconsistency struct {
+	Kind     string            `json:"kind" yaml:"kind"`
+	TypeUrl  string            `json:"type_url" yaml:"type_url"`
+	Resource string            `json:"resource,omitempty" yaml:"resource,omitempty"`
+	Replicas map[string]string `json:"replicas" yaml:"replicas"`
+}
+
+// doFanOut sends the same subscriptions to every endpoint at once, and
+// reports the differences between their responses once all of them are
+// synced. It returns whether the replicas are consistent.
+func doFanOut(ctx *context, newProtocol func(*context) xdsProtocol) (bool, error) {
+	defer ctx.rootCancel()
+
+	donec := make(chan struct{})
+	defer close(donec)
+	go func() {
+		select {
+		case <-ctx.interc:
+			ctx.rootCancel()
+		case <-donec:
+		}
+	}()
+
+	flags := *ctx.flags
+	if flags.readTimeout == 0 {
+		flags.readTimeout = _fanOutReadTimeout
+	}
+
+	// Every replica has its own NACK policy, like a separate client.
+	replicas := make([]*context, len(ctx.endpoints))
+	for i := range replicas {
+		nackPolicy, err := buildNackPolicy(ctx.flags.xds.nackPolicy, ctx.flags.xds.errorDetail)
+		if err != nil {
+			return false, err
+		}
+		replica := *ctx
+		replica.flags = &flags
+		replica.nackPolicy = nackPolicy
+		replicas[i] = &replica
+	}
+
+	// The protocols share the verbose output.
+	var mu sync.Mutex
+	results := make([]*replicaResult, len(ctx.endpoints))
+	for i, ep := range ctx.endpoints {
+		ctx.wg.Add(1)
+		go func(i int, ep endpoint) {
+			defer ctx.wg.Done()
+			results[i] = queryReplica(replicas[i], newProtocol(replicas[i]), ep, &mu)
+		}(i, ep)
+	}
+	ctx.wg.Wait()
+
+	report, err := buildFanOutReport(results)
+	if err != nil {
+		return false, err
+	}
+	data, err := ctx.marshaller.marshal(report)
+	if err != nil {
+		return false, err
+	}
+	fmt.Println(data)
+	return report.Consistent, nil
+}
+
+// queryReplica runs the protocol on the stream to the replica until it's
+// synced.
+func queryReplica(ctx *context, protocol xdsProtocol, ep endpoint, mu *sync.Mutex) *replicaResult {
+	result := &replicaResult{
+		endpoint:  ep.addr,
+		responses: make(map[string]*discoveryv3.DiscoveryResponse),
+	}
+
+	conn, err := newGRPCConn(ctx, ep)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer conn.Close()
+
+	stream, err := protocol.openStream(ctx, conn)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	reqs := protocol.initialRequests(ctx)
+	for {
+		for _, req := range reqs {
+			if err := sendMsg(ctx, conn, stream, req); err != nil {
+				result.err = err
+				return result
+			}
+		}
+		if protocol.synced() {
+			stream.CloseSend()
+			return result
+		}
+
+		resp := protocol.newResponse()
+		if err := recvMsg(ctx, conn, stream, resp); err != nil {
+			result.err = err
+			return result
+		}
+		mu.Lock()
+		_, reqs, err = protocol.handleResponse(ctx, resp)
+		mu.Unlock()
+		if err != nil {
+			result.err = err
+			return result
+		}
+
+		// The subscriptions made by xdscli itself, like the clusters of
+		// the EDS resource names, are not compared.
+		raw := resp.(*discoveryv3.DiscoveryResponse)
+		if len(ctx.typeURLs) > 0 && !containsString(ctx.typeURLs, raw.GetTypeUrl()) {
+			continue
+		}
+		result.responses[raw.GetTypeUrl()] = raw
+	}
+}
+
+func buildFanOutReport(results []*replicaResult) (*fanOutReport, error) {
+	report := &fanOutReport{Consistent: true}
+
+	// fingerprints are the resource fingerprints of each type of each
+	// replica.
+	fingerprints := make(map[string]map[string]map[string]string)
+	versions := make(map[string]map[string]string)
+	typeURLs := make(map[string]struct{})
+	for _, result := range results {
+		summary := replicaSummary{Endpoint: result.endpoint}
+		if result.err != nil {
+			summary.Error = result.err.Error()
+			report.Consistent = false
+			report.Replicas = append(report.Replicas, summary)
+			continue
+		}
+
+		received := make(map[string]struct{}, len(result.responses))
+		for typeURL := range result.responses {
+			received[typeURL] = struct{}{}
+		}
+		for _, typeURL := range sortedKeys(received) {
+			resp := result.responses[typeURL]
+			summary.Types = append(summary.Types, typeSummary{
+				TypeUrl:     typeURL,
+				VersionInfo: resp.GetVersionInfo(),
+				Resources:   len(resp.GetResources()),
+			})
+
+			if versions[typeURL] == nil {
+				typeURLs[typeURL] = struct{}{}
+				versions[typeURL] = make(map[string]string)
+				fingerprints[typeURL] = make(map[string]map[string]string)
+			}
+			versions[typeURL][result.endpoint] = resp.GetVersionInfo()
+			resources, err := fingerprintResources(resp)
+			if err != nil {
+				return nil, err
+			}
+			fingerprints[typeURL][result.endpoint] = resources
+		}
+		report.Replicas = append(report.Replicas, summary)
+	}
+
+	for _, typeURL := range sortedKeys(typeURLs) {
+		if !allEqual(versions[typeURL]) {
+			report.Inconsistencies = append(report.Inconsistencies, inconsistency{
+				Kind:     _inconsistencyVersion,
+				TypeUrl:  typeURL,
+				Replicas: versions[typeURL],
+			})
+		}
+
+		names := make(map[string]struct{})
+		for _, resources := range fingerprints[typeURL] {
+			for name := range resources {
+				names[name] = struct{}{}
+			}
+		}
+		for _, name := range sortedKeys(names) {
+			replicas := make(map[string]string, len(fingerprints[typeURL]))
+			for endpoint, resources := range fingerprints[typeURL] {
+				if fingerprint, ok := resources[name]; ok {
+					replicas[endpoint] = fingerprint
+				} else {
+					replicas[endpoint] = _missing
+				}
+			}
+			if !allEqual(replicas) {
+				report.Inconsistencies = append(report.Inconsistencies, inconsistency{
+					Kind:     _inconsistencyResource,
+					TypeUrl:  typeURL,
+					Resource: name,
+					Replicas: replicas,
+				})
+			}
+		}
+	}
+
+	if len(report.Inconsistencies) > 0 {
+		report.Consistent = false
+	}
+	return report, nil
+}
+
+// fingerprintResources maps the resource names to the fingerprints of the
+// resources, which are the hash of the deterministic serialization, so that
+// the replicas serializing the maps in different orders are still equal.
+func fingerprintResources(resp *discoveryv3.DiscoveryResponse) (map[string]string, error) {
+	fingerprints := make(map[string]string, len(resp.GetResources()))
+	for _, item := range resp.GetResources() {
+		res, err := _resourceTypes.decode(item)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := proto.NewBuffer(nil)
+		buf.SetDeterministic(true)
+		if err := buf.Marshal(res); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		fingerprints[resourceName(res)] = hex.EncodeToString(sum[:6])
+	}
+	return fingerprints, nil
+}
+
+// resourceName returns the name of the xDS resource, which is the cluster name
+// for the ClusterLoadAssignment.
+func resourceName(res proto.Message) string {
+	switch r := res.(type) {
+	case interface{ GetName() string }:
+		return r.GetName()
+	case interface{ GetClusterName() string }:
+		return r.GetClusterName()
+	default:
+		return ""
+	}
+}
+
+func allEqual(m map[string]string) bool {
+	first, ok := "", false
+	for _, value := range m {
+		if !ok {
+			first, ok = value, true
+		} else if value != first {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+func newReplicaResult(t *testing.T, endpoint, version string, clusters ...*clusterv3.Cluster) *replicaResult {
+	typeURL := _typeURLMap[_apiVersion3]["cds"]
+	var resources []*any.Any
+	for _, cluster := range clusters {
+		res, err := ptypes.MarshalAny(cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, res)
+	}
+	return &replicaResult{
+		endpoint: endpoint,
+		responses: map[string]*discoveryv3.DiscoveryResponse{
+			typeURL: {TypeUrl: typeURL, VersionInfo: version, Resources: resources},
+		},
+	}
+}
+
+func TestBuildFanOutReport(t *testing.T) {
+	c1 := &clusterv3.Cluster{Name: "c1", ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS}}
+	c1Static := &clusterv3.Cluster{Name: "c1", ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_STATIC}}
+	c2 := &clusterv3.Cluster{Name: "c2"}
+
+	tests := []struct {
+		name       string
+		results    []*replicaResult
+		consistent bool
+		// inconsistencies are the expected ones, only the listed replicas
+		// are compared.
+		inconsistencies []inconsistency
+	}{
+		{
+			name: "consistent",
+			results: []*replicaResult{
+				newReplicaResult(t, "a", "1", c1, c2),
+				newReplicaResult(t, "b", "1", c2, c1),
+			},
+			consistent: true,
+		},
+		{
+			name: "version",
+			results: []*replicaResult{
+				newReplicaResult(t, "a", "1", c1),
+				newReplicaResult(t, "b", "2", c1),
+			},
+			inconsistencies: []inconsistency{
+				{Kind: _inconsistencyVersion, Replicas: map[string]string{"a": "1", "b": "2"}},
+			},
+		},
+		{
+			name: "resources",
+			results: []*replicaResult{
+				newReplicaResult(t, "a", "1", c1, c2),
+				newReplicaResult(t, "b", "1", c1Static),
+			},
+			inconsistencies: []inconsistency{
+				{Kind: _inconsistencyResource, Resource: "c1"},
+				{Kind: _inconsistencyResource, Resource: "c2", Replicas: map[string]string{"b": _missing}},
+			},
+		},
+		{
+			name: "error",
+			results: []*replicaResult{
+				newReplicaResult(t, "a", "1", c1),
+				{endpoint: "b", err: errors.New("unavailable")},
+			},
+		},
+	}
+
+	typeURL := _typeURLMap[_apiVersion3]["cds"]
+	for _, tt := range tests {
+		report, err := buildFanOutReport(tt.results)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if report.Consistent != tt.consistent {
+			t.Errorf("%s: consistent is %v, expected %v", tt.name, report.Consistent, tt.consistent)
+		}
+		if len(report.Replicas) != len(tt.results) {
+			t.Errorf("%s: %d replicas, expected %d", tt.name, len(report.Replicas), len(tt.results))
+		}
+		for i, result := range tt.results {
+			if result.err != nil && report.Replicas[i].Error != result.err.Error() {
+				t.Errorf("%s: the error of %s is %q", tt.name, result.endpoint, report.Replicas[i].Error)
+			}
+		}
+
+		if len(report.Inconsistencies) != len(tt.inconsistencies) {
+			t.Errorf("%s: inconsistencies are %+v, expected %+v", tt.name, report.Inconsistencies, tt.inconsistencies)
+			continue
+		}
+		for i, want := range tt.inconsistencies {
+			got := report.Inconsistencies[i]
+			if got.Kind != want.Kind || got.TypeUrl != typeURL || got.Resource != want.Resource {
+				t.Errorf("%s: inconsistency is %+v, expected %+v", tt.name, got, want)
+			}
+			if len(got.Replicas) != len(tt.results) {
+				t.Errorf("%s: inconsistency %+v doesn't cover every replica", tt.name, got)
+			}
+			for endpoint, value := range want.Replicas {
+				if got.Replicas[endpoint] != value {
+					t.Errorf("%s: %s of %s is %q, expected %q", tt.name, got.Kind, endpoint, got.Replicas[endpoint], value)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+type commandKind int
+
+const (
+	_commandSubscribe commandKind = iota
+	_commandUnsubscribe
+	_commandNack
+)
+
+// command is an interactive command read from stdin, which is one of
+//
+//	+<xds> [names...]  subscribe the resource names, or the type itself
+//	-<xds> [names...]  unsubscribe the resource names, or the type itself
+//	nack [<xds>]       reject the next response of the type, or of any type
+//
+// The names are separated by spaces or commas.
+type command struct {
+	kind    commandKind
+	typeURL string
+	names   []string
+}
+
+func parseCommand(apiVersion, line string) (*command, error) {
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	cmd := &command{}
+	name := fields[0]
+	switch {
+	case name == "nack":
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%v: %s", _errInvalidCommand, line)
+		}
+		cmd.kind = _commandNack
+		if len(fields) == 1 {
+			return cmd, nil
+		}
+		name = fields[1]
+	case strings.HasPrefix(name, "+"):
+		cmd.kind = _commandSubscribe
+		name, cmd.names = name[1:], fields[1:]
+	case strings.HasPrefix(name, "-"):
+		cmd.kind = _commandUnsubscribe
+		name, cmd.names = name[1:], fields[1:]
+	default:
+		return nil, fmt.Errorf("%v: %s", _errInvalidCommand, line)
+	}
+
+	typeURL, err := getDiscoveryServiceTypeUrl(apiVersion, name)
+	if err != nil {
+		return nil, err
+	}
+	cmd.typeURL = typeURL
+	return cmd, nil
+}
+
+// commandThread reads the commands line by line until EOF, the commands are
+// kept across the reconnects. It's not waited for since the read on stdin
+// can't be interrupted.
+func commandThread(r io.Reader, cmdc chan<- string, donec <-chan struct{}) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		select {
+		case cmdc <- scanner.Text():
+		case <-donec:
+			return
+		}
+	}
+}
+
+// handleCommand runs the command and makes the requests for the updated
+// subscriptions. Bad commands are reported without breaking the stream.
+func handleCommand(ctx *context, protocol xdsProtocol, line string) []proto.Message {
+	cmd, err := parseCommand(ctx.flags.xds.apiVersion, line)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return nil
+	}
+	if cmd == nil {
+		return nil
+	}
+
+	if cmd.kind == _commandNack {
+		ctx.manualNack.rejectNext(cmd.typeURL)
+		return nil
+	}
+	if ctx.flags.transport != _transportADS && cmd.typeURL != ctx.typeURLs[0] {
+		// The standalone stream serves a single type.
+		fmt.Fprintf(os.Stderr, "Error: %v: %s\n", _errMultipleTypesNeedADS, line)
+		return nil
+	}
+	reqs, err := protocol.editSubscription(ctx, cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return nil
+	}
+	return reqs
+}
+
+// mergeStrings appends the strings in b but not in a to a copy of a.
+func mergeStrings(a, b []string) []string {
+	merged := append([]string(nil), a...)
+	for _, s := range b {
+		if !containsString(merged, s) {
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
+
+// removeStrings returns the strings in a but not in b.
+func removeStrings(a, b []string) []string {
+	var remained []string
+	for _, s := range a {
+		if !containsString(b, s) {
+			remained = append(remained, s)
+		}
+	}
+	return remained
+}
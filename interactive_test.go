@@ -0,0 +1,79 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	typeURLs := _typeURLMap[_apiVersion3]
+
+	tests := []struct {
+		line string
+		want *command
+		err  bool
+	}{
+		{line: ""},
+		{line: " \t"},
+		{
+			line: "+eds a b",
+			want: &command{kind: _commandSubscribe, typeURL: typeURLs["eds"], names: []string{"a", "b"}},
+		},
+		{
+			line: "+cds c1,c2, c3",
+			want: &command{kind: _commandSubscribe, typeURL: typeURLs["cds"], names: []string{"c1", "c2", "c3"}},
+		},
+		{
+			line: "-rds r1",
+			want: &command{kind: _commandUnsubscribe, typeURL: typeURLs["rds"], names: []string{"r1"}},
+		},
+		{
+			line: "-lds",
+			want: &command{kind: _commandUnsubscribe, typeURL: typeURLs["lds"], names: []string{}},
+		},
+		{
+			line: "nack",
+			want: &command{kind: _commandNack},
+		},
+		{
+			line: "nack sds",
+			want: &command{kind: _commandNack, typeURL: typeURLs["sds"]},
+		},
+		{line: "nack sds cds", err: true},
+		{line: "nack xds", err: true},
+		{line: "+ eds a", err: true},
+		{line: "+xds a", err: true},
+		{line: "eds a", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseCommand(_apiVersion3, tt.line)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, expected %+v", tt.line, got, tt.want)
+		}
+	}
+}
@@ -17,11 +17,11 @@ package main
 import (
 	gcontext "context"
 	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
-	// "fmt"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -31,32 +31,83 @@ var (
 	_gFlags = &globalFlags{}
 
 	_rootCmd = &cobra.Command{
-		Use:          "xdscli [options] <xds>",
+		Use:          "xdscli [options] <xds> [<xds>...]",
 		Short:        "xDS protocol client",
 		Long:         "xDS protocol client to talk with management servers like Istio Pilot",
 		SilenceUsage: true,
+		Args:         cobra.ArbitraryArgs,
 		Run:          rootCommandFunc,
 	}
+
+	_dumpCmd = &cobra.Command{
+		Use:          "dump [options]",
+		Short:        "Dump the listeners, routes, clusters and endpoints that the node sees",
+		Long:         "Dump the listeners, routes, clusters and endpoints that the node sees, they are fetched one after another on the same ADS stream like a warming Envoy",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		Run:          dumpCommandFunc,
+	}
 )
 
 const (
 	_defaultDialTimeout = 2 * time.Second
+
+	_defaultKeepaliveTime    = 30 * time.Second
+	_defaultKeepaliveTimeout = 2 * time.Second
+
+	_defaultBackoffBaseDelay = time.Second
+	_defaultBackoffMaxDelay  = 30 * time.Second
 )
 
 func init() {
 	_rootCmd.PersistentFlags().BoolVarP(&_gFlags.showVersion, "version", "v", false, "show the version of xdscli")
-	_rootCmd.PersistentFlags().StringSliceVar(&_gFlags.servers, "servers", nil, "xDS server addresses")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.bootstrap, "bootstrap", "", "the gRPC xDS bootstrap file to take the server, node, channel credentials and API version from, defaults to $GRPC_XDS_BOOTSTRAP, the flags specified explicitly take precedence")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.envoyBootstrap, "envoy-bootstrap", "", "the Envoy bootstrap file to take the node, and the server, TLS and initial metadata of the ADS cluster from, the flags specified explicitly take precedence")
+	_rootCmd.PersistentFlags().StringSliceVar(&_gFlags.servers, "servers", nil, "xDS server addresses, like host:port, dns:///host:port and unix:///path/to/socket, the servers of a host without port are looked up from the SRV record _grpc._tcp.<host>")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.resolver, "resolver", "", "the DNS server (ip[:port]) to resolve the server hosts with, instead of the system resolver")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.proxy, "proxy", "", "tunnel the connections through the proxy, http://[user:password@]host:port for HTTP CONNECT or socks5://[user:password@]host:port, the server hosts are resolved by the proxy unless --resolver is specified")
 	_rootCmd.PersistentFlags().StringVar(&_gFlags.outputFormat, "write-out", "simple", "set the output format (json, yaml, simple)")
+	_rootCmd.PersistentFlags().IntVar(&_gFlags.indent, "indent", 2, "the number of spaces to indent the json output with, 0 for the compact output")
 	_rootCmd.PersistentFlags().DurationVar(&_gFlags.dialTimeout, "dial-timeout", _defaultDialTimeout, "dial timeout for client connections")
+	_rootCmd.PersistentFlags().DurationVar(&_gFlags.readTimeout, "read-timeout", 0, "timeout for each response until every subscription is responded, 0 means no timeout, or 10s for each replica with --fan-out, exits with 124 on timeout in one-shot mode")
+	_rootCmd.PersistentFlags().DurationVar(&_gFlags.sendTimeout, "send-timeout", 0, "timeout for sending each request, the stream is canceled on timeout, 0 means no timeout")
+
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.tls.cacert, "cacert", "", "verify the certificates of the TLS-enabled servers using this CA bundle")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.tls.cert, "cert", "", "identify the client using this TLS certificate file")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.tls.key, "key", "", "identify the client using this TLS key file")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.tls.serverName, "server-name", "", "the server name to verify the server certificate with, instead of the host of the server")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.tls.insecureSkipVerify, "insecure-skip-verify", false, "skip the server certificate verification, any of the TLS flags enables TLS")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.token, "token", "", "the bearer token sent in the authorization metadata of the streams")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.plaintextToken, "plaintext-token", false, "allow sending the token without TLS to the servers other than the loopback and unix domain socket ones")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.tokenFile, "token-file", "", "the file of the bearer token, it's read again whenever a stream is opened so the rotated token is used")
+	_rootCmd.PersistentFlags().StringArrayVar(&_gFlags.headers, "header", nil, "key=value gRPC metadata sent with the streams, can be repeated")
 
 	_rootCmd.PersistentFlags().StringVar(&_gFlags.xds.node, "node", "", "the node making the request")
 	_rootCmd.PersistentFlags().StringVar(&_gFlags.xds.initialVersionInfo, "initial-version-info", "", "the version_info received with the most recent successfully processed response")
 	_rootCmd.PersistentFlags().StringVar(&_gFlags.xds.errorDetail, "error-detail", "", "the error reason that update configuration cannot be applied, using non-empty string means the discovery response will be rejected by xdscli")
-	_rootCmd.PersistentFlags().StringSliceVar(&_gFlags.xds.resourceNames, "resource-names", nil, "list of resources to subscribe to")
-	_rootCmd.PersistentFlags().StringVar(&_gFlags.xds.apiVersion, "api-version", "v2", "version of xDS protocol")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.xds.nackPolicy, "nack-policy", "", "the responses to be rejected with --error-detail (all, first=N, version=REGEX), N is counted for each resource type")
+	_rootCmd.PersistentFlags().StringSliceVar(&_gFlags.xds.resourceNames, "resource-names", nil, "list of resources to subscribe to, prefix the names with the type like eds=a,b when multiple types are subscribed")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.xds.apiVersion, "api-version", _apiVersion3, "version of xDS protocol (v2, v3)")
 	_rootCmd.PersistentFlags().StringVar(&_gFlags.xds.nodeMetadata, "node-metadata", "", "comma splitted key value pairs reresent node metadata")
-	_rootCmd.PersistentFlags().BoolVar(&_gFlags.watch, "watch", false, "continually watch the config update")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.watch, "watch", false, "continually watch the config update, the broken streams are reopened with backoff on the next server")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.verbose, "verbose", false, "print the ACK/NACK state of the subscriptions to stderr")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.fanOut, "fan-out", false, "send the same subscriptions to every resolved server at once and report the replicas that return different versions or resources, exits with 2 if they differ")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.interactive, "interactive", false, "read the commands from stdin to edit the subscriptions in watch mode: +<xds> [names], -<xds> [names] and nack [<xds>]")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.transport, "transport", _transportADS, "set the discovery service transport (ads, standalone), standalone uses the per-type discovery service like EndpointDiscoveryService")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.delta, "delta", false, "use the incremental (delta) xDS protocol")
+	_rootCmd.PersistentFlags().StringSliceVar(&_gFlags.xds.initialResourceVersions, "initial-resource-versions", nil, "comma splitted name=version pairs represent the resources that xdscli already has, only valid with --delta")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.showSecrets, "show-secrets", false, "print the private keys and other secrets in full instead of redacting them")
 	_rootCmd.PersistentFlags().IntVar(&_gFlags.grpcMaxCallRecvSize, "grpc-max-call-recv-size", 512*1024*1024, "maximum message size that a gRPC call can accept")
+	_rootCmd.PersistentFlags().Int32Var(&_gFlags.initialWindowSize, "initial-window-size", 0, "the initial HTTP/2 stream window size, 0 means the gRPC default, values less than 64K are ignored")
+	_rootCmd.PersistentFlags().Int32Var(&_gFlags.initialConnWindowSize, "initial-conn-window-size", 0, "the initial HTTP/2 connection window size, 0 means the gRPC default, values less than 64K are ignored")
+	_rootCmd.PersistentFlags().StringVar(&_gFlags.authority, "authority", "", "override the :authority of the streams, which is also the server name to verify if --server-name is absent")
+	_rootCmd.PersistentFlags().DurationVar(&_gFlags.keepaliveTime, "keepalive-time", _defaultKeepaliveTime, "the interval of the keepalive pings, gRPC raises it to 10s at least")
+	_rootCmd.PersistentFlags().DurationVar(&_gFlags.keepaliveTimeout, "keepalive-timeout", _defaultKeepaliveTimeout, "the timeout of the keepalive ping acks")
+	_rootCmd.PersistentFlags().BoolVar(&_gFlags.keepalivePermitWithoutStream, "keepalive-permit-without-stream", true, "send the keepalive pings even without active streams")
+	_rootCmd.PersistentFlags().DurationVar(&_gFlags.backoffBaseDelay, "backoff-base-delay", _defaultBackoffBaseDelay, "the backoff delay of the first reconnect, both for the gRPC connection and the stream in watch mode")
+	_rootCmd.PersistentFlags().DurationVar(&_gFlags.backoffMaxDelay, "backoff-max-delay", _defaultBackoffMaxDelay, "the upper bound of the reconnect backoff delay")
+
+	_rootCmd.AddCommand(_dumpCmd)
 
 	cobra.EnablePrefixMatching = true
 }
@@ -66,48 +117,167 @@ func rootCommandFunc(cmd *cobra.Command, args []string) {
 		showVersionAndQuit()
 	}
 
-	if len(args) != 1 {
-		exitWithError(_exitBadArgs, errors.New("need exactly one argument as the discovery service type (like eds, cds and etc)."))
+	if len(args) == 0 {
+		exitWithError(_exitBadArgs, errors.New("need at least one argument as the discovery service type (like eds, cds, lds, rds and sds)."))
 	}
 
-	if err := validateOptions(); err != nil {
+	if err := validateOptions(cmd); err != nil {
 		exitWithError(_exitBadArgs, err)
 	}
 
-	typeUrl, err := getDiscoveryServiceTypeUrl(_gFlags.xds.apiVersion, args[0])
+	var typeURLs []string
+	for _, arg := range args {
+		typeURL, err := getDiscoveryServiceTypeUrl(_gFlags.xds.apiVersion, arg)
+		if err != nil {
+			exitWithError(_exitBadArgs, err)
+		}
+		if !containsString(typeURLs, typeURL) {
+			typeURLs = append(typeURLs, typeURL)
+		}
+	}
+	if len(typeURLs) > 1 {
+		if _gFlags.transport != _transportADS {
+			exitWithError(_exitBadArgs, _errMultipleTypesNeedADS)
+		}
+		if len(_gFlags.xds.initialResourceVersions) > 0 {
+			exitWithError(_exitBadArgs, fmt.Errorf("%v: only valid with a single type", _errInvalidInitialResourceVersions))
+		}
+	}
+	resourceNames, err := buildResourceNames(_gFlags.xds.apiVersion, typeURLs, _gFlags.xds.resourceNames)
 	if err != nil {
 		exitWithError(_exitBadArgs, err)
 	}
 
+	ctx := newContext(typeURLs, resourceNames)
+	if _gFlags.fanOut {
+		runFanOut(ctx, newXDSProtocol)
+		return
+	}
+	if err := doDiscoveryService(ctx, newXDSProtocol(ctx)); err != nil {
+		exitWithError(exitCode(err), err)
+	}
+}
+
+func dumpCommandFunc(cmd *cobra.Command, args []string) {
+	if _gFlags.showVersion {
+		showVersionAndQuit()
+	}
+
+	if err := validateOptions(cmd); err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+
+	if _gFlags.delta || _gFlags.transport != _transportADS {
+		exitWithError(_exitBadArgs, _errDumpNeedsADS)
+	}
+
+	ctx := newContext(nil, nil)
+	if _gFlags.fanOut {
+		runFanOut(ctx, newDumpProtocol)
+		return
+	}
+	if err := doDiscoveryService(ctx, newDumpProtocol(ctx)); err != nil {
+		exitWithError(exitCode(err), err)
+	}
+}
+
+func runFanOut(ctx *context, newProtocol func(*context) xdsProtocol) {
+	consistent, err := doFanOut(ctx, newProtocol)
+	if err != nil {
+		exitWithError(_exitError, err)
+	}
+	if !consistent {
+		exitWithError(_exitInconsistent, nil)
+	}
+}
+
+// newContext builds the context from the validated options.
+func newContext(typeURLs []string, resourceNames map[string][]string) *context {
 	if len(_gFlags.servers) == 0 {
 		exitWithError(_exitBadArgs, _errNoServers)
 	}
-	endpoints, err := validateAndResolveServers(_gFlags.servers)
+	proxyURL, err := buildProxyURL(_gFlags.proxy)
+	if err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+	resolver, err := buildResolver(_gFlags.resolver)
+	if err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+	if proxyURL != nil && _gFlags.resolver == "" {
+		// The server hosts may be only resolvable behind the proxy.
+		resolver = nil
+	}
+	resolveCtx, resolveCancel := gcontext.WithTimeout(gcontext.Background(), _gFlags.dialTimeout)
+	endpoints, err := validateAndResolveServers(resolveCtx, _gFlags.servers, resolver)
+	resolveCancel()
 	if err != nil {
 		exitWithError(_exitError, err)
 	}
 
-	marshaller := buildOutputMarshaller(_gFlags.outputFormat)
+	tlsConfig, err := buildTLSConfig(&_gFlags.tls)
+	if err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+
+	// The token is only sent in plaintext to the servers on this host, unless
+	// it's allowed explicitly.
+	plaintextToken := tlsConfig == nil && (_gFlags.plaintextToken || proxyURL == nil && localEndpoints(endpoints))
+	if tlsConfig == nil && !plaintextToken && (_gFlags.token != "" || _gFlags.tokenFile != "") {
+		exitWithError(_exitBadArgs, _errTokenNeedsTLS)
+	}
+	callCreds, err := buildCallCredentials(_gFlags.token, _gFlags.tokenFile, plaintextToken)
+	if err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+
+	headers, err := buildHeaders(_gFlags.headers, _gFlags.bootstrapHeaders, callCreds != nil)
+	if err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+
+	marshaller := buildOutputMarshaller(_gFlags.outputFormat, _gFlags.indent)
 	nodeMeta, err := buildNodeMetadata(_gFlags.xds.nodeMetadata)
+	if err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+	initialResourceVersions, err := buildInitialResourceVersions(_gFlags.xds.initialResourceVersions)
+	if err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+	nackPolicy, err := buildNackPolicy(_gFlags.xds.nackPolicy, _gFlags.xds.errorDetail)
+	if err != nil {
+		exitWithError(_exitBadArgs, err)
+	}
+	var manualNack *manualNackPolicy
+	if _gFlags.interactive {
+		manualNack = &manualNackPolicy{nackPolicy: nackPolicy, pending: make(map[string]bool)}
+		nackPolicy = manualNack
+	}
 	rootCtx, cancel := gcontext.WithCancel(gcontext.Background())
 
 	signalc := make(chan os.Signal, 1)
 	signal.Notify(signalc, syscall.SIGINT, syscall.SIGTERM)
 
-	ctx := context{
+	return &context{
 		interc:     signalc,
 		rootCtx:    rootCtx,
 		rootCancel: cancel,
 		flags:      _gFlags,
 		endpoints:  endpoints,
-		typeUrl:    typeUrl,
+		proxyURL:   proxyURL,
+		tlsConfig:  tlsConfig,
+		callCreds:  callCreds,
+		headers:    headers,
 		nodeMeta:   nodeMeta,
-		wg:         sync.WaitGroup{},
+		wg:         &sync.WaitGroup{},
 		marshaller: marshaller,
-	}
+		nackPolicy: nackPolicy,
+		manualNack: manualNack,
 
-	if err := doDiscoveryService(&ctx); err != nil {
-		exitWithError(_exitError, err)
+		typeURLs:                typeURLs,
+		resourceNames:           resourceNames,
+		initialResourceVersions: initialResourceVersions,
 	}
 }
 
@@ -0,0 +1,141 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	_nackPolicyAll     = "all"
+	_nackPolicyFirst   = "first"
+	_nackPolicyVersion = "version"
+
+	_defaultErrorDetail = "rejected by xdscli"
+)
+
+// nackPolicy decides whether a response should be rejected (NACKed).
+type nackPolicy interface {
+	reject(typeURL, version string) bool
+}
+
+// noneNackPolicy accepts all the responses.
+type noneNackPolicy struct{}
+
+// allNackPolicy rejects all the responses.
+type allNackPolicy struct{}
+
+// firstNackPolicy rejects the first n responses of each type.
+type firstNackPolicy struct {
+	n      int
+	counts map[string]int
+}
+
+// versionNackPolicy rejects the responses whose version matches the pattern.
+type versionNackPolicy struct {
+	pattern *regexp.Regexp
+}
+
+// manualNackPolicy rejects the next response of the types requested by the
+// interactive nack command, the other responses are left to the wrapped
+// policy.
+type manualNackPolicy struct {
+	nackPolicy
+	// pending are the types whose next response will be rejected, the
+	// empty type url stands for any type.
+	pending map[string]bool
+}
+
+func (p *noneNackPolicy) reject(typeURL, version string) bool {
+	return false
+}
+
+func (p *allNackPolicy) reject(typeURL, version string) bool {
+	return true
+}
+
+func (p *firstNackPolicy) reject(typeURL, version string) bool {
+	p.counts[typeURL]++
+	return p.counts[typeURL] <= p.n
+}
+
+func (p *versionNackPolicy) reject(typeURL, version string) bool {
+	return p.pattern.MatchString(version)
+}
+
+func (p *manualNackPolicy) reject(typeURL, version string) bool {
+	if p.pending[typeURL] || p.pending[""] {
+		delete(p.pending, typeURL)
+		delete(p.pending, "")
+		return true
+	}
+	return p.nackPolicy.reject(typeURL, version)
+}
+
+// rejectNext rejects the next response of the type, or of any type if the type
+// url is empty.
+func (p *manualNackPolicy) rejectNext(typeURL string) {
+	p.pending[typeURL] = true
+}
+
+// buildNackPolicy parses the --nack-policy value, which is one of "all",
+// "first=N" and "version=REGEX". Without policy, all the responses are
+// rejected if the --error-detail is specified, just like before the policies
+// were introduced.
+func buildNackPolicy(spec, errorDetail string) (nackPolicy, error) {
+	if spec == "" {
+		if errorDetail != "" {
+			return &allNackPolicy{}, nil
+		}
+		return &noneNackPolicy{}, nil
+	}
+
+	parts := strings.SplitN(spec, "=", 2)
+	switch {
+	case parts[0] == _nackPolicyAll && len(parts) == 1:
+		return &allNackPolicy{}, nil
+	case parts[0] == _nackPolicyFirst && len(parts) == 2:
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 {
+			return nil, _errInvalidNackPolicy
+		}
+		return &firstNackPolicy{n: n, counts: make(map[string]int)}, nil
+	case parts[0] == _nackPolicyVersion && len(parts) == 2:
+		pattern, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return &versionNackPolicy{pattern: pattern}, nil
+	default:
+		return nil, _errInvalidNackPolicy
+	}
+}
+
+// makeErrorDetail makes the error_detail of the NACK request.
+func makeErrorDetail(ctx *context) *status.Status {
+	message := ctx.flags.xds.errorDetail
+	if message == "" {
+		message = _defaultErrorDetail
+	}
+	return &status.Status{
+		Code:    int32(codes.Internal),
+		Message: message,
+	}
+}
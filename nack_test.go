@@ -0,0 +1,116 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildNackPolicy(t *testing.T) {
+	type response struct {
+		typeURL string
+		version string
+		reject  bool
+	}
+
+	tests := []struct {
+		spec        string
+		errorDetail string
+		err         bool
+		responses   []response
+	}{
+		{
+			spec:      "",
+			responses: []response{{"cds", "1", false}, {"cds", "2", false}},
+		},
+		{
+			spec:        "",
+			errorDetail: "bad config",
+			responses:   []response{{"cds", "1", true}, {"eds", "1", true}},
+		},
+		{
+			spec:      "all",
+			responses: []response{{"cds", "1", true}, {"cds", "2", true}},
+		},
+		{
+			spec: "first=2",
+			responses: []response{
+				{"cds", "1", true},
+				{"eds", "1", true},
+				{"cds", "2", true},
+				{"cds", "3", false},
+				{"eds", "2", true},
+				{"eds", "3", false},
+			},
+		},
+		{
+			spec: "version=^bad-",
+			responses: []response{
+				{"cds", "1", false},
+				{"cds", "bad-2", true},
+				{"eds", "good-bad-3", false},
+			},
+		},
+		{spec: "all=1", err: true},
+		{spec: "first", err: true},
+		{spec: "first=0", err: true},
+		{spec: "first=x", err: true},
+		{spec: "version=(", err: true},
+		{spec: "random", err: true},
+	}
+
+	for _, tt := range tests {
+		policy, err := buildNackPolicy(tt.spec, tt.errorDetail)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		for _, resp := range tt.responses {
+			if reject := policy.reject(resp.typeURL, resp.version); reject != resp.reject {
+				t.Errorf("%q: %s version %s: reject is %v, expected %v",
+					tt.spec, resp.typeURL, resp.version, reject, resp.reject)
+			}
+		}
+	}
+}
+
+func TestManualNackPolicy(t *testing.T) {
+	policy := &manualNackPolicy{nackPolicy: &noneNackPolicy{}, pending: make(map[string]bool)}
+
+	policy.rejectNext("cds")
+	if policy.reject("eds", "1") {
+		t.Error("eds is rejected by the nack command of cds")
+	}
+	if !policy.reject("cds", "1") {
+		t.Error("cds is not rejected by the nack command")
+	}
+	if policy.reject("cds", "2") {
+		t.Error("cds is rejected twice by one nack command")
+	}
+
+	policy.rejectNext("")
+	if !policy.reject("lds", "1") {
+		t.Error("lds is not rejected by the nack command of any type")
+	}
+	if policy.reject("cds", "3") {
+		t.Error("cds is rejected after the nack command of any type is used")
+	}
+}
@@ -16,11 +16,17 @@ package main
 
 import (
 	gcontext "context"
+	"crypto/tls"
+	"net/url"
 	"os"
 	"sync"
 	"time"
 
 	_struct "github.com/golang/protobuf/ptypes/struct"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 )
 
 // xdsFlags are flags the defined about the DiscoveryRequest.
@@ -31,32 +37,106 @@ type xdsFlags struct {
 	errorDetail        string
 	resourceNames      []string
 	apiVersion         string
+	nackPolicy         string
+
+	initialResourceVersions []string
+
+	// bootstrapNode is the node in the gRPC or Envoy bootstrap file.
+	bootstrapNode *corev3.Node
+}
+
+// tlsFlags are flags about the TLS of the connections.
+type tlsFlags struct {
+	cacert             string
+	cert               string
+	key                string
+	serverName         string
+	insecureSkipVerify bool
+	// enabled is set by the bootstrap file to use TLS even without any of
+	// the TLS flags.
+	enabled bool
 }
 
 // globalFlags are flags that defined globally.
 type globalFlags struct {
 	xds xdsFlags
+	tls tlsFlags
 
 	dialTimeout time.Duration
 	readTimeout time.Duration
 	sendTimeout time.Duration
 
-	grpcMaxCallRecvSize int
+	grpcMaxCallRecvSize   int
+	initialWindowSize     int32
+	initialConnWindowSize int32
+	authority             string
+
+	keepaliveTime                time.Duration
+	keepaliveTimeout             time.Duration
+	keepalivePermitWithoutStream bool
 
-	outputFormat string
-	servers      []string
-	watch        bool
-	showVersion  bool
+	backoffBaseDelay time.Duration
+	backoffMaxDelay  time.Duration
+
+	token          string
+	tokenFile      string
+	plaintextToken bool
+	headers        []string
+	// bootstrapHeaders are the initial metadata in the Envoy bootstrap, the
+	// keys set by --header or the token are not taken from them.
+	bootstrapHeaders []string
+
+	outputFormat   string
+	indent         int
+	transport      string
+	servers        []string
+	resolver       string
+	proxy          string
+	watch          bool
+	delta          bool
+	showSecrets    bool
+	showVersion    bool
+	bootstrap      string
+	envoyBootstrap string
+	verbose        bool
+	interactive    bool
+	fanOut         bool
+}
+
+// endpoint is an address of the servers to dial.
+type endpoint struct {
+	addr string
+	// authority is the server target that the address was resolved from,
+	// the server certificate is verified against its host.
+	authority string
 }
 
 type context struct {
 	rootCtx    gcontext.Context
 	rootCancel gcontext.CancelFunc
 	flags      *globalFlags
-	endpoints  []string
-	typeUrl    string
+	endpoints  []endpoint
+	// proxyURL is the proxy to tunnel the TCP connections through.
+	proxyURL   *url.URL
+	tlsConfig  *tls.Config
+	callCreds  credentials.PerRPCCredentials
+	headers    metadata.MD
 	marshaller marshaller
+	nackPolicy nackPolicy
+	// manualNack is the NACK policy that the interactive nack command
+	// drives, it's nil if not in the interactive mode.
+	manualNack *manualNackPolicy
 	nodeMeta   *_struct.Struct
-	wg         sync.WaitGroup
+	wg         *sync.WaitGroup
 	interc     chan os.Signal
+
+	// typeURLs are the resource types to subscribe, in the order they were
+	// specified.
+	typeURLs []string
+	// resourceNames are the resource names to subscribe of each type.
+	resourceNames map[string][]string
+
+	// initialResourceVersions are the resource versions that the delta
+	// xDS client already has.
+	initialResourceVersions map[string]string
 }
@@ -15,95 +15,219 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"reflect"
+	"strings"
 
-	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	"github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 )
 
 type discoveryResponse struct {
-	VersionInfo  string             `json:"version_info,omitempty",yaml:"version_info,omitempty"`
-	Resources    []interface{}      `json:"resources,omitempty",yaml:"resources,omitempty"`
-	Canary       bool               `json:"canary,omitempty",yaml:"canary,omitempty"`
-	TypeUrl      string             `json:"type_url,omitempty",yaml:"type_url,omitempty"`
-	Nonce        string             `json:"nonce,omitempty",yaml:"nonce,omitempty"`
-	ControlPlane *core.ControlPlane `json:"control_plane,omitempty",yaml:"control_plane,omitempty"`
+	VersionInfo  string        `json:"version_info,omitempty" yaml:"version_info,omitempty"`
+	Resources    []interface{} `json:"resources,omitempty" yaml:"resources,omitempty"`
+	Canary       bool          `json:"canary,omitempty" yaml:"canary,omitempty"`
+	TypeUrl      string        `json:"type_url,omitempty" yaml:"type_url,omitempty"`
+	Nonce        string        `json:"nonce,omitempty" yaml:"nonce,omitempty"`
+	ControlPlane *protoMessage `json:"control_plane,omitempty" yaml:"control_plane,omitempty"`
+}
+
+type deltaDiscoveryResponse struct {
+	SystemVersionInfo string            `json:"system_version_info,omitempty" yaml:"system_version_info,omitempty"`
+	Resources         []deltaResource   `json:"resources,omitempty" yaml:"resources,omitempty"`
+	TypeUrl           string            `json:"type_url,omitempty" yaml:"type_url,omitempty"`
+	RemovedResources  []string          `json:"removed_resources,omitempty" yaml:"removed_resources,omitempty"`
+	Nonce             string            `json:"nonce,omitempty" yaml:"nonce,omitempty"`
+	ResourceVersions  map[string]string `json:"resource_versions,omitempty" yaml:"resource_versions,omitempty"`
 }
 
+type deltaResource struct {
+	Name     string      `json:"name,omitempty" yaml:"name,omitempty"`
+	Aliases  []string    `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	Version  string      `json:"version,omitempty" yaml:"version,omitempty"`
+	Resource interface{} `json:"resource,omitempty" yaml:"resource,omitempty"`
+}
+
+// marshaller marshals the structured output, like the discoveryResponse.
 type marshaller interface {
-	marshal(*apiv2.DiscoveryResponse) (string, error)
+	marshal(interface{}) (string, error)
 }
 
 type jsonMarshaller struct {
-	keepIndent bool
+	// indent is the indentation of each level, the output is compact if
+	// it's empty.
+	indent string
 }
 
 type defaultMarshaller struct{}
 type yamlMarshaller struct{}
 
-func convertToStructuredDiscoveryResponse(raw *apiv2.DiscoveryResponse) (*discoveryResponse, error) {
+// protoMessage marshals the message with the proto3 JSON mapping, and the
+// original field names like Envoy's config_dump.
+type protoMessage struct {
+	proto.Message
+}
+
+func (m protoMessage) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	marshaler := &jsonpb.Marshaler{OrigName: true, AnyResolver: anyResolver{}}
+	if err := marshaler.Marshal(&buf, m.Message); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// anyResolver resolves the Any messages nested in the resources, like the
+// typed configs of the filters. The types that aren't linked in are kept as
+// the serialized bytes.
+type anyResolver struct{}
+
+func (anyResolver) Resolve(typeURL string) (proto.Message, error) {
+	name := typeURL[strings.LastIndex(typeURL, "/")+1:]
+	if typ := proto.MessageType(name); typ != nil {
+		return reflect.New(typ.Elem()).Interface().(proto.Message), nil
+	}
+	return &unknownMessage{}, nil
+}
+
+// unknownMessage is the message of an unknown type, it's shown as the base64
+// of its serialized bytes.
+type unknownMessage struct {
+	value []byte
+}
+
+func (m *unknownMessage) Reset()         { m.value = nil }
+func (m *unknownMessage) String() string { return base64.StdEncoding.EncodeToString(m.value) }
+func (m *unknownMessage) ProtoMessage()  {}
+
+func (m *unknownMessage) Unmarshal(data []byte) error {
+	m.value = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *unknownMessage) MarshalJSONPB(*jsonpb.Marshaler) ([]byte, error) {
+	return json.Marshal(map[string][]byte{"value": m.value})
+}
+
+func decodeResource(item *any.Any, showSecrets bool) (interface{}, error) {
+	res, err := _resourceTypes.decode(item)
+	if err != nil {
+		return nil, err
+	}
+	if !showSecrets {
+		redactSecret(res)
+	}
+	return protoMessage{res}, nil
+}
+
+func convertToStructuredDiscoveryResponse(raw *discoveryv3.DiscoveryResponse, showSecrets bool) (*discoveryResponse, error) {
 	resp := &discoveryResponse{
-		VersionInfo:  raw.GetVersionInfo(),
-		Resources:    make([]interface{}, len(raw.GetResources())),
-		Canary:       raw.GetCanary(),
-		TypeUrl:      raw.GetTypeUrl(),
-		Nonce:        raw.GetNonce(),
-		ControlPlane: raw.GetControlPlane(),
+		VersionInfo: raw.GetVersionInfo(),
+		Resources:   make([]interface{}, len(raw.GetResources())),
+		Canary:      raw.GetCanary(),
+		TypeUrl:     raw.GetTypeUrl(),
+		Nonce:       raw.GetNonce(),
+	}
+	if cp := raw.GetControlPlane(); cp != nil {
+		resp.ControlPlane = &protoMessage{cp}
+	}
+
+	for i, item := range raw.GetResources() {
+		res, err := decodeResource(item, showSecrets)
+		if err != nil {
+			return nil, err
+		}
+		resp.Resources[i] = res
+	}
+
+	return resp, nil
+}
+
+// convertToStructuredDeltaDiscoveryResponse converts the delta response, the
+// versions are all resources known so far.
+func convertToStructuredDeltaDiscoveryResponse(raw *discoveryv3.DeltaDiscoveryResponse, versions map[string]string, showSecrets bool) (*deltaDiscoveryResponse, error) {
+	resp := &deltaDiscoveryResponse{
+		SystemVersionInfo: raw.GetSystemVersionInfo(),
+		Resources:         make([]deltaResource, len(raw.GetResources())),
+		TypeUrl:           raw.GetTypeUrl(),
+		RemovedResources:  raw.GetRemovedResources(),
+		Nonce:             raw.GetNonce(),
+		ResourceVersions:  versions,
 	}
 
 	for i, item := range raw.GetResources() {
-		switch item.GetTypeUrl() {
-		case _typeURLMap["eds"]:
-			target := &apiv2.ClusterLoadAssignment{}
-			if err := proto.Unmarshal(item.GetValue(), target); err != nil {
-				return nil, err
-			}
-			resp.Resources[i] = target
-		default:
-			return nil, _errUnknownTypeUrl
+		resp.Resources[i] = deltaResource{
+			Name:    item.GetName(),
+			Aliases: item.GetAliases(),
+			Version: item.GetVersion(),
 		}
+		if item.GetResource() == nil {
+			continue
+		}
+		res, err := decodeResource(item.GetResource(), showSecrets)
+		if err != nil {
+			return nil, err
+		}
+		resp.Resources[i].Resource = res
 	}
 
 	return resp, nil
 }
 
-func newJSONMarshaller() marshaller {
-	return &jsonMarshaller{keepIndent: true}
+func newJSONMarshaller(indent int) marshaller {
+	return &jsonMarshaller{indent: strings.Repeat(" ", indent)}
 }
 
-func (f *jsonMarshaller) marshal(raw *apiv2.DiscoveryResponse) (string, error) {
-	resp, err := convertToStructuredDiscoveryResponse(raw)
-	if err != nil {
+func (f *jsonMarshaller) marshal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil || f.indent == "" {
+		return string(data), err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", f.indent); err != nil {
 		return "", err
 	}
-	data, err := json.Marshal(resp)
-	return string(data), err
+	return buf.String(), nil
 }
 
 func newDefaultMarshaller() marshaller {
 	return &defaultMarshaller{}
 }
 
-func (f *defaultMarshaller) marshal(raw *apiv2.DiscoveryResponse) (string, error) {
-	resp, err := convertToStructuredDiscoveryResponse(raw)
-	if err != nil {
-		return "", err
-	}
-	return fmt.Sprint(*resp), nil
+func (f *defaultMarshaller) marshal(v interface{}) (string, error) {
+	return fmt.Sprint(reflect.Indirect(reflect.ValueOf(v))), nil
 }
 
 func newYAMLMarshaller() marshaller {
 	return &yamlMarshaller{}
 }
 
-func (f *yamlMarshaller) marshal(raw *apiv2.DiscoveryResponse) (string, error) {
-	resp, err := convertToStructuredDiscoveryResponse(raw)
+// marshal converts the JSON output to YAML, so that both follow the proto3
+// JSON mapping. The fields are kept in order.
+func (f *yamlMarshaller) marshal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return "", err
 	}
-	data, err := yaml.Marshal(resp)
+	var out yaml.MapSlice
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		return "", err
+	}
+	data, err = yaml.Marshal(out)
 	return string(data), err
 }
+
+// configDump is everything a node sees, the output of the dump command.
+type configDump struct {
+	Listeners discoveryResponse `json:"listeners" yaml:"listeners"`
+	Routes    discoveryResponse `json:"routes" yaml:"routes"`
+	Clusters  discoveryResponse `json:"clusters" yaml:"clusters"`
+	Endpoints discoveryResponse `json:"endpoints" yaml:"endpoints"`
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	routev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discoveryv2 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	runtimev3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+)
+
+const (
+	_typeURLPrefix = "type.googleapis.com/"
+)
+
+// _resourceTypes are the xDS resources that xdscli is able to decode, a new
+// resource type can be supported by appending its message here.
+var _resourceTypes = newResourceRegistry(
+	// xDS v2
+	&apiv2.Cluster{},
+	&apiv2.ClusterLoadAssignment{},
+	&apiv2.Listener{},
+	&apiv2.RouteConfiguration{},
+	&apiv2.ScopedRouteConfiguration{},
+	&authv2.Secret{},
+	&discoveryv2.Runtime{},
+	&routev2.VirtualHost{},
+
+	// xDS v3
+	&clusterv3.Cluster{},
+	&endpointv3.ClusterLoadAssignment{},
+	&listenerv3.Listener{},
+	&routev3.RouteConfiguration{},
+	&routev3.ScopedRouteConfiguration{},
+	&tlsv3.Secret{},
+	&runtimev3.Runtime{},
+	&routev3.VirtualHost{},
+)
+
+// resourceRegistry maps the Any type url of a resource to its message type.
+type resourceRegistry map[string]reflect.Type
+
+func newResourceRegistry(msgs ...proto.Message) resourceRegistry {
+	registry := make(resourceRegistry, len(msgs))
+	for _, msg := range msgs {
+		registry[_typeURLPrefix+proto.MessageName(msg)] = reflect.TypeOf(msg).Elem()
+	}
+	return registry
+}
+
+// decode unmarshals the resource wrapped in the Any message.
+func (r resourceRegistry) decode(res *any.Any) (proto.Message, error) {
+	typ, ok := r[res.GetTypeUrl()]
+	if !ok {
+		return nil, fmt.Errorf("%v: %s", _errUnknownTypeUrl, res.GetTypeUrl())
+	}
+
+	msg := reflect.New(typ).Interface().(proto.Message)
+	if err := proto.Unmarshal(res.GetValue(), msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
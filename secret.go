@@ -0,0 +1,183 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	corev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+)
+
+const (
+	_redacted = "[redacted]"
+)
+
+// redactSecret wipes the key materials inlined anywhere in the resource, like
+// the TLS certificates of the Secrets, or of the TLS contexts of the listeners
+// and the clusters, so that they won't be leaked to the terminal. The typed
+// configs are inspected as well.
+func redactSecret(res proto.Message) {
+	redactValue(reflect.ValueOf(res))
+}
+
+// redactValue walks the message fields, it reports whether anything was
+// redacted.
+func redactValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || !v.CanInterface() {
+			return false
+		}
+		if redacted, ok := redactMessage(v.Interface()); ok {
+			return redacted
+		}
+		return redactValue(v.Elem())
+	case reflect.Interface:
+		// The oneof fields.
+		if v.IsNil() {
+			return false
+		}
+		return redactValue(v.Elem())
+	case reflect.Struct:
+		redacted := false
+		for i := 0; i < v.NumField(); i++ {
+			if strings.HasPrefix(v.Type().Field(i).Name, "XXX_") {
+				continue
+			}
+			if redactValue(v.Field(i)) {
+				redacted = true
+			}
+		}
+		return redacted
+	case reflect.Slice:
+		redacted := false
+		for i := 0; i < v.Len(); i++ {
+			if redactValue(v.Index(i)) {
+				redacted = true
+			}
+		}
+		return redacted
+	case reflect.Map:
+		redacted := false
+		iter := v.MapRange()
+		for iter.Next() {
+			if redactValue(iter.Value()) {
+				redacted = true
+			}
+		}
+		return redacted
+	default:
+		return false
+	}
+}
+
+// redactMessage redacts the messages that carry the key materials, and the
+// messages wrapped in the Any. It reports whether anything was redacted, and
+// whether the message was handled.
+func redactMessage(msg interface{}) (bool, bool) {
+	switch m := msg.(type) {
+	case *any.Any:
+		return redactAny(m), true
+	case *authv2.TlsCertificate:
+		redactDataSourceV2(m.PrivateKey)
+		redactDataSourceV2(m.Password)
+		if provider := m.GetPrivateKeyProvider(); provider.GetConfigType() != nil {
+			provider.ConfigType = &authv2.PrivateKeyProvider_TypedConfig{TypedConfig: redactedAny()}
+		}
+		return true, true
+	case *tlsv3.TlsCertificate:
+		redactDataSourceV3(m.PrivateKey)
+		redactDataSourceV3(m.Password)
+		if provider := m.GetPrivateKeyProvider(); provider.GetConfigType() != nil {
+			provider.ConfigType = &tlsv3.PrivateKeyProvider_TypedConfig{TypedConfig: redactedAny()}
+		}
+		return true, true
+	case *authv2.TlsSessionTicketKeys:
+		for _, key := range m.GetKeys() {
+			redactDataSourceV2(key)
+		}
+		return true, true
+	case *tlsv3.TlsSessionTicketKeys:
+		for _, key := range m.GetKeys() {
+			redactDataSourceV3(key)
+		}
+		return true, true
+	case *authv2.GenericSecret:
+		redactDataSourceV2(m.GetSecret())
+		return true, true
+	case *tlsv3.GenericSecret:
+		redactDataSourceV3(m.GetSecret())
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// redactAny redacts the message wrapped in the Any, which is serialized again
+// if anything was redacted. The messages of the unknown types are left as
+// they are.
+func redactAny(a *any.Any) bool {
+	name := a.GetTypeUrl()[strings.LastIndex(a.GetTypeUrl(), "/")+1:]
+	typ := proto.MessageType(name)
+	if typ == nil {
+		return false
+	}
+	msg := reflect.New(typ.Elem()).Interface().(proto.Message)
+	if err := proto.Unmarshal(a.GetValue(), msg); err != nil {
+		return false
+	}
+	if !redactValue(reflect.ValueOf(msg)) {
+		return false
+	}
+	value, err := proto.Marshal(msg)
+	if err != nil {
+		return false
+	}
+	a.Value = value
+	return true
+}
+
+// redactedAny replaces the config of the private key provider, which is
+// specific to the provider and may carry the keys.
+func redactedAny() *any.Any {
+	a, _ := ptypes.MarshalAny(&wrappers.StringValue{Value: _redacted})
+	return a
+}
+
+// redactDataSourceV2 replaces the inlined data, file names are kept as they
+// are not sensitive.
+func redactDataSourceV2(ds *corev2.DataSource) {
+	switch ds.GetSpecifier().(type) {
+	case *corev2.DataSource_InlineBytes, *corev2.DataSource_InlineString:
+		ds.Specifier = &corev2.DataSource_InlineString{InlineString: _redacted}
+	}
+}
+
+// redactDataSourceV3 is the xDS v3 version of redactDataSourceV2.
+func redactDataSourceV3(ds *corev3.DataSource) {
+	switch ds.GetSpecifier().(type) {
+	case *corev3.DataSource_InlineBytes, *corev3.DataSource_InlineString:
+		ds.Specifier = &corev3.DataSource_InlineString{InlineString: _redacted}
+	}
+}
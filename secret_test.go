@@ -0,0 +1,145 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	corev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+)
+
+func inlineV2(s string) *corev2.DataSource {
+	return &corev2.DataSource{Specifier: &corev2.DataSource_InlineString{InlineString: s}}
+}
+
+func inlineV3(s string) *corev3.DataSource {
+	return &corev3.DataSource{Specifier: &corev3.DataSource_InlineString{InlineString: s}}
+}
+
+func TestRedactSecret(t *testing.T) {
+	providerConfig, err := ptypes.MarshalAny(&wrappers.StringValue{Value: "provider-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	downstream, err := ptypes.MarshalAny(&tlsv3.DownstreamTlsContext{
+		CommonTlsContext: &tlsv3.CommonTlsContext{
+			TlsCertificates: []*tlsv3.TlsCertificate{{
+				CertificateChain: inlineV3("listener-cert"),
+				PrivateKey:       inlineV3("listener-key"),
+			}},
+		},
+		SessionTicketKeysType: &tlsv3.DownstreamTlsContext_SessionTicketKeys{
+			SessionTicketKeys: &tlsv3.TlsSessionTicketKeys{Keys: []*corev3.DataSource{inlineV3("ticket-key")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		res     proto.Message
+		secrets []string
+		kept    []string
+	}{
+		{
+			name: "v3 secret",
+			res: &tlsv3.Secret{
+				Name: "s1",
+				Type: &tlsv3.Secret_TlsCertificate{TlsCertificate: &tlsv3.TlsCertificate{
+					CertificateChain: inlineV3("secret-cert"),
+					PrivateKey:       inlineV3("secret-key"),
+					Password:         inlineV3("secret-password"),
+					PrivateKeyProvider: &tlsv3.PrivateKeyProvider{
+						ProviderName: "p",
+						ConfigType:   &tlsv3.PrivateKeyProvider_TypedConfig{TypedConfig: providerConfig},
+					},
+				}},
+			},
+			secrets: []string{"secret-key", "secret-password", "provider-key"},
+			kept:    []string{"secret-cert"},
+		},
+		{
+			name: "v2 generic secret",
+			res: &authv2.Secret{
+				Name: "s2",
+				Type: &authv2.Secret_GenericSecret{GenericSecret: &authv2.GenericSecret{Secret: inlineV2("generic-value")}},
+			},
+			secrets: []string{"generic-value"},
+		},
+		{
+			name: "v3 listener transport socket",
+			res: &listenerv3.Listener{
+				Name: "l1",
+				FilterChains: []*listenerv3.FilterChain{{
+					TransportSocket: &corev3.TransportSocket{
+						Name:       "envoy.transport_sockets.tls",
+						ConfigType: &corev3.TransportSocket_TypedConfig{TypedConfig: downstream},
+					},
+				}},
+			},
+			secrets: []string{"listener-key", "ticket-key"},
+			kept:    []string{"listener-cert"},
+		},
+		{
+			name: "v2 cluster tls context",
+			res: &apiv2.Cluster{
+				Name: "c1",
+				TlsContext: &authv2.UpstreamTlsContext{
+					CommonTlsContext: &authv2.CommonTlsContext{
+						TlsCertificates: []*authv2.TlsCertificate{{
+							CertificateChain: inlineV2("cluster-cert"),
+							PrivateKey:       inlineV2("cluster-key"),
+						}},
+					},
+				},
+			},
+			secrets: []string{"cluster-key"},
+			kept:    []string{"cluster-cert"},
+		},
+	}
+
+	for _, tt := range tests {
+		redactSecret(tt.res)
+		data, err := protoMessage{tt.res}.MarshalJSON()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		out := string(data)
+		for _, secret := range tt.secrets {
+			if strings.Contains(out, secret) {
+				t.Errorf("%s: %q is not redacted: %s", tt.name, secret, out)
+			}
+		}
+		for _, kept := range tt.kept {
+			if !strings.Contains(out, kept) {
+				t.Errorf("%s: %q is redacted: %s", tt.name, kept, out)
+			}
+		}
+		if !strings.Contains(out, _redacted) {
+			t.Errorf("%s: no redaction marker: %s", tt.name, out)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// subscription is the state of the resources of a type subscribed on the
+// stream.
+type subscription struct {
+	typeURL       string
+	resourceNames []string
+	// version is the version_info of the last accepted response.
+	version string
+	nonce   string
+	// received is set once the first response arrived.
+	received bool
+	// rejected is set if the last response was NACKed.
+	rejected bool
+	// silent subscriptions are made by xdscli itself, their responses are
+	// neither printed nor rejected by the NACK policy.
+	silent bool
+}
+
+// sotwProtocol is the state of the world variant of the xDS protocol.
+type sotwProtocol struct {
+	subscriptions map[string]*subscription
+	// order is the type urls in the order they were subscribed, the initial
+	// requests are sent in this order.
+	order []string
+	// initialVersion is the version_info of the subscriptions before any
+	// response is accepted.
+	initialVersion string
+	// unsubscribed are the types unsubscribed by the interactive commands,
+	// their late responses are ignored.
+	unsubscribed map[string]bool
+	// edsFromCDS is set when the EDS resource names are collected from the
+	// clusters, just like what Envoy does.
+	edsFromCDS bool
+	// edsPending is set until the clusters are responded, the EDS
+	// subscription can't be made before that.
+	edsPending bool
+}
+
+func newSotwProtocol(ctx *context) xdsProtocol {
+	p := &sotwProtocol{
+		subscriptions:  make(map[string]*subscription),
+		unsubscribed:   make(map[string]bool),
+		initialVersion: ctx.flags.xds.initialVersionInfo,
+	}
+
+	typeURLs := _typeURLMap[ctx.flags.xds.apiVersion]
+	for _, typeURL := range ctx.typeURLs {
+		names := ctx.resourceNames[typeURL]
+		if typeURL == typeURLs["eds"] && len(names) == 0 && ctx.flags.transport == _transportADS {
+			// Clusters are fetched first on the same stream, the
+			// endpoints will be subscribed once the cluster names are
+			// known.
+			p.edsFromCDS = true
+			p.edsPending = true
+			continue
+		}
+		p.subscribe(typeURL, names)
+	}
+	if _, ok := p.subscriptions[typeURLs["cds"]]; p.edsFromCDS && !ok {
+		p.subscribe(typeURLs["cds"], nil).silent = true
+	}
+	return p
+}
+
+func (p *sotwProtocol) subscribe(typeURL string, resourceNames []string) *subscription {
+	sub := &subscription{
+		typeURL:       typeURL,
+		resourceNames: resourceNames,
+		version:       p.initialVersion,
+	}
+	p.subscriptions[typeURL] = sub
+	p.order = append(p.order, typeURL)
+	delete(p.unsubscribed, typeURL)
+	return sub
+}
+
+func (p *sotwProtocol) openStream(ctx *context, conn *grpc.ClientConn) (grpc.ClientStream, error) {
+	return openDiscoveryStream(ctx, conn, false)
+}
+
+func (p *sotwProtocol) newResponse() proto.Message {
+	return &discoveryv3.DiscoveryResponse{}
+}
+
+func (p *sotwProtocol) initialRequests(ctx *context) []proto.Message {
+	var reqs []proto.Message
+	for _, typeURL := range p.order {
+		sub := p.subscriptions[typeURL]
+		// The nonce belongs to the previous stream if it's reopened, but the
+		// last accepted version is kept.
+		sub.nonce = ""
+		reqs = append(reqs, makeDiscoveryRequest(ctx, sub, nil))
+	}
+	return reqs
+}
+
+func (p *sotwProtocol) handleResponse(ctx *context, msg proto.Message) (interface{}, []proto.Message, error) {
+	resp := msg.(*discoveryv3.DiscoveryResponse)
+	if p.ignored(ctx, resp.GetTypeUrl()) {
+		return nil, nil, nil
+	}
+	sub, ack, err := p.ack(ctx, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	reqs := []proto.Message{ack}
+
+	if p.edsFromCDS && sub.typeURL == _typeURLMap[ctx.flags.xds.apiVersion]["cds"] {
+		// Like Envoy, the endpoints of the rejected clusters are not
+		// subscribed.
+		p.edsPending = false
+		if !sub.rejected {
+			names, err := edsResourceNames(resp.GetResources())
+			if err != nil {
+				return nil, nil, err
+			}
+			if req := p.resubscribe(ctx, _typeURLMap[ctx.flags.xds.apiVersion]["eds"], names); req != nil {
+				reqs = append(reqs, req)
+			}
+		}
+	}
+
+	if sub.silent {
+		return nil, reqs, nil
+	}
+
+	out, err := convertToStructuredDiscoveryResponse(resp, ctx.flags.showSecrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, reqs, nil
+}
+
+// ack updates the subscription of the response and makes the ACK request, or
+// the NACK request if the NACK policy rejects the response. Both carry the
+// nonce of the response, but the NACK request keeps the version_info of the
+// last accepted response.
+func (p *sotwProtocol) ack(ctx *context, resp *discoveryv3.DiscoveryResponse) (*subscription, proto.Message, error) {
+	sub, ok := p.subscriptions[resp.GetTypeUrl()]
+	if !ok {
+		return nil, nil, fmt.Errorf("%v: %s", _errUnknownTypeUrl, resp.GetTypeUrl())
+	}
+
+	sub.nonce = resp.GetNonce()
+	sub.received = true
+	sub.rejected = !sub.silent && ctx.nackPolicy.reject(sub.typeURL, resp.GetVersionInfo())
+
+	var errorDetail *status.Status
+	if sub.rejected {
+		errorDetail = makeErrorDetail(ctx)
+		verbosef(ctx, "NACK %s: version_info=%q response_nonce=%q rejected_version_info=%q",
+			sub.typeURL, sub.version, sub.nonce, resp.GetVersionInfo())
+	} else {
+		sub.version = resp.GetVersionInfo()
+		verbosef(ctx, "ACK %s: version_info=%q response_nonce=%q", sub.typeURL, sub.version, sub.nonce)
+	}
+	return sub, makeDiscoveryRequest(ctx, sub, errorDetail), nil
+}
+
+// resubscribe makes the request when the resource names collected from the
+// dependent resources are changed, like the EDS resource names of the
+// clusters.
+func (p *sotwProtocol) resubscribe(ctx *context, typeURL string, names []string) proto.Message {
+	// An empty resource name list means subscribing all the resources.
+	if len(names) == 0 {
+		return nil
+	}
+
+	sub, ok := p.subscriptions[typeURL]
+	if !ok {
+		sub = p.subscribe(typeURL, names)
+	} else if !equalStrings(sub.resourceNames, names) {
+		sub.resourceNames = names
+	} else {
+		return nil
+	}
+	return makeDiscoveryRequest(ctx, sub, nil)
+}
+
+// editSubscription changes the resource names of the type. Unsubscribing a
+// type sends an empty resource name list, since it means all the resources
+// for the listeners and clusters, they can't be unsubscribed all.
+func (p *sotwProtocol) editSubscription(ctx *context, cmd *command) ([]proto.Message, error) {
+	if cmd.typeURL == _typeURLMap[ctx.flags.xds.apiVersion]["eds"] {
+		// The endpoints no longer follow the clusters once edited by hand.
+		p.edsFromCDS = false
+		p.edsPending = false
+	}
+
+	sub, ok := p.subscriptions[cmd.typeURL]
+	switch {
+	case cmd.kind == _commandSubscribe && !ok:
+		sub = p.subscribe(cmd.typeURL, cmd.names)
+	case cmd.kind == _commandSubscribe:
+		names := mergeStrings(sub.resourceNames, cmd.names)
+		if equalStrings(names, sub.resourceNames) && !sub.silent {
+			return nil, nil
+		}
+		sub.resourceNames = names
+		sub.silent = false
+	case !ok:
+		return nil, nil
+	case wildcardType(ctx.flags.xds.apiVersion, cmd.typeURL) &&
+		(len(cmd.names) == 0 || len(sub.resourceNames) > 0 && len(removeStrings(sub.resourceNames, cmd.names)) == 0):
+		return nil, _errWildcardUnsubscribe
+	case len(cmd.names) == 0:
+		p.unsubscribe(cmd.typeURL)
+		sub.resourceNames = nil
+	default:
+		names := removeStrings(sub.resourceNames, cmd.names)
+		if equalStrings(names, sub.resourceNames) {
+			return nil, nil
+		}
+		sub.resourceNames = names
+	}
+	return []proto.Message{makeDiscoveryRequest(ctx, sub, nil)}, nil
+}
+
+// wildcardType reports whether an empty resource name list subscribes all the
+// resources of the type, which are the listeners and clusters.
+func wildcardType(apiVersion, typeURL string) bool {
+	typeURLs := _typeURLMap[apiVersion]
+	return typeURL == typeURLs["lds"] || typeURL == typeURLs["cds"]
+}
+
+// ignored reports whether the response is of a type that was unsubscribed.
+func (p *sotwProtocol) ignored(ctx *context, typeURL string) bool {
+	if p.unsubscribed[typeURL] {
+		verbosef(ctx, "IGNORE %s: the type was unsubscribed", typeURL)
+		return true
+	}
+	return false
+}
+
+func (p *sotwProtocol) unsubscribe(typeURL string) {
+	delete(p.subscriptions, typeURL)
+	p.order = removeStrings(p.order, []string{typeURL})
+	p.unsubscribed[typeURL] = true
+}
+
+func (p *sotwProtocol) synced() bool {
+	if p.edsPending {
+		return false
+	}
+	for _, sub := range p.subscriptions {
+		if !sub.received {
+			return false
+		}
+	}
+	return true
+}
+
+func makeDiscoveryRequest(ctx *context, sub *subscription, errorDetail *status.Status) *discoveryv3.DiscoveryRequest {
+	discReq := &discoveryv3.DiscoveryRequest{
+		VersionInfo:   sub.version,
+		Node:          makeNode(ctx),
+		ResourceNames: sub.resourceNames,
+		TypeUrl:       sub.typeURL,
+		ResponseNonce: sub.nonce,
+		ErrorDetail:   errorDetail,
+	}
+	return discReq
+}
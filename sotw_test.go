@@ -0,0 +1,249 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+func newSotwTestContext(policy nackPolicy, types ...string) *context {
+	ctx := &context{
+		flags: &globalFlags{
+			xds: xdsFlags{
+				node:               "sidecar~10.0.0.1~a.b~b.svc.cluster.local",
+				initialVersionInfo: "0",
+				apiVersion:         _apiVersion3,
+			},
+			transport: _transportADS,
+		},
+		nackPolicy:    policy,
+		resourceNames: make(map[string][]string),
+	}
+	for _, typ := range types {
+		ctx.typeURLs = append(ctx.typeURLs, _typeURLMap[_apiVersion3][typ])
+	}
+	return ctx
+}
+
+func makeEDSClusters(t *testing.T, names ...string) []*any.Any {
+	var resources []*any.Any
+	for _, name := range names {
+		res, err := ptypes.MarshalAny(&clusterv3.Cluster{
+			Name:                 name,
+			ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, res)
+	}
+	return resources
+}
+
+func TestSotwProtocolVersionTracking(t *testing.T) {
+	policy, err := buildNackPolicy("version=^bad", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newSotwTestContext(policy, "cds")
+	cds := ctx.typeURLs[0]
+	p := newSotwProtocol(ctx)
+
+	reqs := p.initialRequests(ctx)
+	if len(reqs) != 1 {
+		t.Fatalf("%d initial requests, expected 1", len(reqs))
+	}
+	if req := reqs[0].(*discoveryv3.DiscoveryRequest); req.GetVersionInfo() != "0" || req.GetResponseNonce() != "" {
+		t.Errorf("initial request has version_info %q and nonce %q", req.GetVersionInfo(), req.GetResponseNonce())
+	}
+
+	responses := []struct {
+		version string
+		nonce   string
+		// ackVersion is the version_info of the request that answers the
+		// response.
+		ackVersion string
+		nack       bool
+	}{
+		{version: "1", nonce: "a", ackVersion: "1"},
+		{version: "bad-2", nonce: "b", ackVersion: "1", nack: true},
+		{version: "bad-3", nonce: "c", ackVersion: "1", nack: true},
+		{version: "4", nonce: "d", ackVersion: "4"},
+	}
+	for _, r := range responses {
+		resp := &discoveryv3.DiscoveryResponse{
+			TypeUrl:     cds,
+			VersionInfo: r.version,
+			Nonce:       r.nonce,
+			Resources:   makeEDSClusters(t, "c1"),
+		}
+		out, reqs, err := p.handleResponse(ctx, resp)
+		if err != nil {
+			t.Fatalf("version %s: %v", r.version, err)
+		}
+		if out == nil {
+			t.Errorf("version %s: the response is not printed", r.version)
+		}
+		if len(reqs) != 1 {
+			t.Fatalf("version %s: %d requests, expected 1", r.version, len(reqs))
+		}
+		req := reqs[0].(*discoveryv3.DiscoveryRequest)
+		if req.GetVersionInfo() != r.ackVersion {
+			t.Errorf("version %s: request version_info is %q, expected %q", r.version, req.GetVersionInfo(), r.ackVersion)
+		}
+		if req.GetResponseNonce() != r.nonce {
+			t.Errorf("version %s: request nonce is %q, expected %q", r.version, req.GetResponseNonce(), r.nonce)
+		}
+		if nack := req.GetErrorDetail() != nil; nack != r.nack {
+			t.Errorf("version %s: NACK is %v, expected %v", r.version, nack, r.nack)
+		}
+	}
+
+	// The reopened stream starts with the last accepted version but no nonce.
+	reqs = p.initialRequests(ctx)
+	if req := reqs[0].(*discoveryv3.DiscoveryRequest); req.GetVersionInfo() != "4" || req.GetResponseNonce() != "" {
+		t.Errorf("reopened request has version_info %q and nonce %q", req.GetVersionInfo(), req.GetResponseNonce())
+	}
+}
+
+func TestSotwProtocolEDSFromCDS(t *testing.T) {
+	ctx := newSotwTestContext(&allNackPolicy{}, "eds")
+	cds := _typeURLMap[_apiVersion3]["cds"]
+	eds := _typeURLMap[_apiVersion3]["eds"]
+	p := newSotwProtocol(ctx)
+
+	reqs := p.initialRequests(ctx)
+	if len(reqs) != 1 || reqs[0].(*discoveryv3.DiscoveryRequest).GetTypeUrl() != cds {
+		t.Fatalf("initial requests are %v, expected the clusters only", reqs)
+	}
+	if p.synced() {
+		t.Error("synced before the endpoints are subscribed")
+	}
+
+	// The hidden clusters are accepted whatever the NACK policy is.
+	out, reqs, err := p.handleResponse(ctx, &discoveryv3.DiscoveryResponse{
+		TypeUrl:     cds,
+		VersionInfo: "1",
+		Nonce:       "a",
+		Resources:   makeEDSClusters(t, "c1", "c2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		t.Error("the hidden clusters are printed")
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("%d requests, expected the clusters ACK and the endpoints", len(reqs))
+	}
+	ack := reqs[0].(*discoveryv3.DiscoveryRequest)
+	if ack.GetVersionInfo() != "1" || ack.GetErrorDetail() != nil {
+		t.Errorf("the hidden clusters are not ACKed: %v", ack)
+	}
+	sub := reqs[1].(*discoveryv3.DiscoveryRequest)
+	if sub.GetTypeUrl() != eds || !equalStrings(sub.GetResourceNames(), []string{"c1", "c2"}) {
+		t.Errorf("the endpoints subscription is %v", sub)
+	}
+	if p.synced() {
+		t.Error("synced before the endpoints are responded")
+	}
+
+	out, reqs, err = p.handleResponse(ctx, &discoveryv3.DiscoveryResponse{
+		TypeUrl:     eds,
+		VersionInfo: "1",
+		Nonce:       "b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil {
+		t.Error("the endpoints are not printed")
+	}
+	if nack := reqs[0].(*discoveryv3.DiscoveryRequest); nack.GetErrorDetail() == nil || nack.GetVersionInfo() != "0" {
+		t.Errorf("the endpoints are not NACKed: %v", nack)
+	}
+	if !p.synced() {
+		t.Error("not synced after the endpoints are responded")
+	}
+}
+
+func TestSotwProtocolEditSubscription(t *testing.T) {
+	tests := []struct {
+		line string
+		// names are the resource names of the subscriptions before the
+		// command, nil subscribes all.
+		names []string
+		// want is the resource names of the request, nil if no request.
+		want []string
+		err  bool
+	}{
+		{line: "+cds c2", names: []string{"c1"}, want: []string{"c1", "c2"}},
+		{line: "+cds c1", names: []string{"c1"}},
+		{line: "-cds c1", names: []string{"c1", "c2"}, want: []string{"c2"}},
+		{line: "-cds c3", names: []string{"c1", "c2"}},
+		// The empty resource names would subscribe all the clusters.
+		{line: "-cds c1", names: []string{"c1"}, err: true},
+		{line: "-cds", names: []string{"c1"}, err: true},
+		{line: "-cds", err: true},
+		{line: "-lds l1", names: []string{"l1"}, err: true},
+		{line: "-eds e1", names: []string{"e1"}, want: []string{}},
+		{line: "-eds", names: []string{"e1"}, want: []string{}},
+		{line: "-rds r1", names: []string{"r1"}},
+	}
+
+	for _, tt := range tests {
+		ctx := newSotwTestContext(&noneNackPolicy{}, "lds", "cds", "eds")
+		for _, typeURL := range ctx.typeURLs {
+			ctx.resourceNames[typeURL] = tt.names
+		}
+		p := newSotwProtocol(ctx)
+
+		cmd, err := parseCommand(_apiVersion3, tt.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs, err := p.editSubscription(ctx, cmd)
+		if tt.err {
+			if err != _errWildcardUnsubscribe {
+				t.Errorf("%q: expected %v, got %v", tt.line, _errWildcardUnsubscribe, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if tt.want == nil {
+			if len(reqs) != 0 {
+				t.Errorf("%q: unexpected requests %v", tt.line, reqs)
+			}
+			continue
+		}
+		if len(reqs) != 1 {
+			t.Errorf("%q: %d requests, expected 1", tt.line, len(reqs))
+			continue
+		}
+		req := reqs[0].(*discoveryv3.DiscoveryRequest)
+		if req.GetTypeUrl() != cmd.typeURL || !equalStrings(req.GetResourceNames(), tt.want) {
+			t.Errorf("%q: request is %v, expected the names %v", tt.line, req, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	_transportADS        = "ads"
+	_transportStandalone = "standalone"
+)
+
+// discoveryService is the gRPC service of a discovery service, the streams
+// are named as "Stream<resource>" and "Delta<resource>".
+type discoveryService struct {
+	name     string
+	resource string
+}
+
+var (
+	// _adsServices are the aggregated discovery services of each xDS API
+	// version.
+	_adsServices = map[string]discoveryService{
+		_apiVersion2: {"envoy.service.discovery.v2.AggregatedDiscoveryService", "AggregatedResources"},
+		_apiVersion3: {"envoy.service.discovery.v3.AggregatedDiscoveryService", "AggregatedResources"},
+	}
+
+	// _standaloneServices maps the resource type url to the standalone
+	// (non-aggregated) discovery service that serves it.
+	_standaloneServices = map[string]discoveryService{
+		_typeURLMap[_apiVersion2]["eds"]: {"envoy.api.v2.EndpointDiscoveryService", "Endpoints"},
+		_typeURLMap[_apiVersion2]["cds"]: {"envoy.api.v2.ClusterDiscoveryService", "Clusters"},
+		_typeURLMap[_apiVersion2]["lds"]: {"envoy.api.v2.ListenerDiscoveryService", "Listeners"},
+		_typeURLMap[_apiVersion2]["rds"]: {"envoy.api.v2.RouteDiscoveryService", "Routes"},
+		_typeURLMap[_apiVersion2]["sds"]: {"envoy.service.discovery.v2.SecretDiscoveryService", "Secrets"},
+
+		_typeURLMap[_apiVersion3]["eds"]: {"envoy.service.endpoint.v3.EndpointDiscoveryService", "Endpoints"},
+		_typeURLMap[_apiVersion3]["cds"]: {"envoy.service.cluster.v3.ClusterDiscoveryService", "Clusters"},
+		_typeURLMap[_apiVersion3]["lds"]: {"envoy.service.listener.v3.ListenerDiscoveryService", "Listeners"},
+		_typeURLMap[_apiVersion3]["rds"]: {"envoy.service.route.v3.RouteDiscoveryService", "Routes"},
+		_typeURLMap[_apiVersion3]["sds"]: {"envoy.service.secret.v3.SecretDiscoveryService", "Secrets"},
+	}
+)
+
+// openDiscoveryStream opens the discovery stream through the transport
+// specified by --transport. The discovery messages of xDS v2 and v3 are wire
+// compatible, so the stream is always fed with the v3 messages, only the gRPC
+// service differs.
+func openDiscoveryStream(ctx *context, conn *grpc.ClientConn, delta bool) (grpc.ClientStream, error) {
+	svc := _adsServices[ctx.flags.xds.apiVersion]
+	if ctx.flags.transport == _transportStandalone {
+		svc = _standaloneServices[ctx.typeURLs[0]]
+	}
+
+	desc := &grpc.StreamDesc{
+		StreamName:    "Stream" + svc.resource,
+		ServerStreams: true,
+		ClientStreams: true,
+	}
+	if delta {
+		desc.StreamName = "Delta" + svc.resource
+	}
+	streamCtx := metadata.NewOutgoingContext(ctx.rootCtx, ctx.headers)
+	return conn.NewStream(streamCtx, desc, "/"+svc.name+"/"+desc.StreamName)
+}
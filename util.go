@@ -15,25 +15,47 @@
 package main
 
 import (
+	gcontext "context"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	_struct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/metadata"
 )
 
 const (
 	_apiVersion2          = "v2"
+	_apiVersion3          = "v3"
 	_serviceNodeSeparator = "~"
+
+	_unixScheme = "unix"
+	_dnsScheme  = "dns"
 )
 
 var (
-	_typeURLMap = map[string]string{
-		"eds": "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment",
-		"cds": "type.googleapis.com/envoy.api.v2.Cluster",
+	// _typeURLMap maps the discovery service to its resource type url, for
+	// each supported xDS API version.
+	_typeURLMap = map[string]map[string]string{
+		_apiVersion2: {
+			"eds": "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment",
+			"cds": "type.googleapis.com/envoy.api.v2.Cluster",
+			"lds": "type.googleapis.com/envoy.api.v2.Listener",
+			"rds": "type.googleapis.com/envoy.api.v2.RouteConfiguration",
+			"sds": "type.googleapis.com/envoy.api.v2.auth.Secret",
+		},
+		_apiVersion3: {
+			"eds": "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment",
+			"cds": "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+			"lds": "type.googleapis.com/envoy.config.listener.v3.Listener",
+			"rds": "type.googleapis.com/envoy.config.route.v3.RouteConfiguration",
+			"sds": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+		},
 	}
 )
 
@@ -43,7 +65,7 @@ func init() {
 
 func validateAPIVersion(ver string) error {
 	switch ver {
-	case _apiVersion2:
+	case _apiVersion2, _apiVersion3:
 	default:
 		return fmt.Errorf("bad api version: %s", ver)
 	}
@@ -60,6 +82,12 @@ func validateTimeoutValue() error {
 	if _gFlags.sendTimeout < 0 {
 		return _errInvalidSendTimeout
 	}
+	if _gFlags.keepaliveTime <= 0 || _gFlags.keepaliveTimeout <= 0 {
+		return _errInvalidKeepalive
+	}
+	if _gFlags.backoffBaseDelay <= 0 || _gFlags.backoffMaxDelay < _gFlags.backoffBaseDelay {
+		return _errInvalidBackoff
+	}
 	return nil
 }
 
@@ -71,41 +99,184 @@ func validateOutputFormat() error {
 	default:
 		return _errInvalidOutputFormat
 	}
+	if _gFlags.indent < 0 {
+		return _errInvalidIndent
+	}
 	return nil
 }
 
-func validateAndResolveServers(servers []string) ([]string, error) {
-	var endpoints []string
-	for _, srv := range servers {
-		host, port, err := net.SplitHostPort(srv)
-		if err != nil {
-			return nil, err
-		}
+func validateTransport() error {
+	switch _gFlags.transport {
+	case _transportADS, _transportStandalone:
+	default:
+		return _errInvalidTransport
+	}
+	return nil
+}
 
-		if ip := net.ParseIP(host); ip != nil {
-			endpoints = append(endpoints, net.JoinHostPort(ip.String(), port))
-		} else {
-			// Try to resolve this host.
-			// TODO Support custom DNS resolver by adding a new command option
-			// like --resolver.
-			addrs, err := net.LookupHost(host)
+// validateAndResolveServers parses the server targets, which are
+// "host:port", "dns://[dns-server]/host:port" or "unix:///path/to/socket". The
+// hosts are resolved here, an endpoint is made for each address with the
+// "host:port" as its authority, and the unix domain sockets are kept as
+// "unix:<path>" endpoints for the dialer. The port
+// can be omitted to look it up from the SRV record "_grpc._tcp.<host>". Without
+// the resolver, the hosts are kept for the proxy to resolve.
+func validateAndResolveServers(ctx gcontext.Context, servers []string, resolver *net.Resolver) ([]endpoint, error) {
+	var endpoints []endpoint
+	for _, srv := range servers {
+		switch {
+		case strings.HasPrefix(srv, _unixScheme+":"):
+			path := strings.TrimPrefix(srv, _unixScheme+":")
+			if strings.HasPrefix(path, "//") {
+				// unix://absolute_path
+				path = path[2:]
+			}
+			if path == "" {
+				return nil, fmt.Errorf("%v: %s", _errInvalidServer, srv)
+			}
+			// The socket path isn't a valid :authority.
+			endpoints = append(endpoints, endpoint{addr: _unixScheme + ":" + path, authority: "localhost"})
+		case strings.HasPrefix(srv, _dnsScheme+":"):
+			hostport := strings.TrimPrefix(srv, _dnsScheme+":")
+			dnsResolver := resolver
+			if strings.HasPrefix(hostport, "//") {
+				// dns://[authority]/host:port, the authority is the DNS
+				// server.
+				parts := strings.SplitN(hostport[2:], "/", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("%v: %s", _errInvalidServer, srv)
+				}
+				if parts[0] != "" {
+					var err error
+					if dnsResolver, err = buildResolver(parts[0]); err != nil {
+						return nil, fmt.Errorf("%v: %s", _errInvalidServer, srv)
+					}
+				}
+				hostport = parts[1]
+			}
+			addrs, err := resolveHostPort(ctx, dnsResolver, hostport)
 			if err != nil {
 				return nil, err
 			}
-
-			for _, addr := range addrs {
-				endpoints = append(endpoints, net.JoinHostPort(addr, port))
+			endpoints = append(endpoints, addrs...)
+		default:
+			addrs, err := resolveHostPort(ctx, resolver, srv)
+			if err != nil {
+				return nil, err
 			}
+			endpoints = append(endpoints, addrs...)
+		}
+	}
+
+	return endpoints, nil
+}
+
+// localEndpoints reports whether all the endpoints are on this host, which are
+// the loopback addresses and the unix domain sockets.
+func localEndpoints(endpoints []endpoint) bool {
+	for _, ep := range endpoints {
+		if strings.HasPrefix(ep.addr, _unixScheme+":") {
+			continue
+		}
+		host, _, err := net.SplitHostPort(ep.addr)
+		if err != nil {
+			return false
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return false
 		}
 	}
+	return true
+}
+
+func resolveHostPort(ctx gcontext.Context, resolver *net.Resolver, hostport string) ([]endpoint, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		if !strings.Contains(hostport, ":") {
+			// No port, look up the servers from the SRV record.
+			return resolveSRV(ctx, resolver, hostport)
+		}
+		return nil, err
+	}
+
+	hostport = net.JoinHostPort(host, port)
+	if ip := net.ParseIP(host); ip != nil {
+		return []endpoint{{addr: net.JoinHostPort(ip.String(), port), authority: hostport}}, nil
+	}
+	if resolver == nil {
+		return []endpoint{{addr: hostport, authority: hostport}}, nil
+	}
 
+	// Try to resolve this host.
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []endpoint
+	for _, addr := range addrs {
+		endpoints = append(endpoints, endpoint{addr: net.JoinHostPort(addr, port), authority: hostport})
+	}
 	return endpoints, nil
 }
 
-func buildOutputMarshaller(format string) marshaller {
+// resolveSRV resolves the servers of the SRV record, the name can be either
+// the host like "istiod.istio-system.svc" or the full record name like
+// "_grpc._tcp.istiod.istio-system.svc".
+func resolveSRV(ctx gcontext.Context, resolver *net.Resolver, name string) ([]endpoint, error) {
+	service, proto := "grpc", "tcp"
+	if strings.HasPrefix(name, "_") {
+		service, proto = "", ""
+	}
+	lookup := resolver
+	if lookup == nil {
+		lookup = net.DefaultResolver
+	}
+	_, srvs, err := lookup.LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []endpoint
+	for _, srv := range srvs {
+		// The target is a fully qualified name, like "xds.example.com.".
+		target := strings.TrimSuffix(srv.Target, ".")
+		addrs, err := resolveHostPort(ctx, resolver, net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, addrs...)
+	}
+	return endpoints, nil
+}
+
+// buildResolver builds the resolver which sends the queries to the DNS server
+// at addr, the port is 53 if it's omitted.
+func buildResolver(addr string) (*net.Resolver, error) {
+	if addr == "" {
+		return net.DefaultResolver, nil
+	}
+
+	if net.ParseIP(strings.Trim(addr, "[]")) != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, _errInvalidResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx gcontext.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+func buildOutputMarshaller(format string, indent int) marshaller {
 	switch format {
 	case "json":
-		return newJSONMarshaller()
+		return newJSONMarshaller(indent)
 	case "simple":
 		return newDefaultMarshaller()
 	case "yaml":
@@ -116,17 +287,46 @@ func buildOutputMarshaller(format string) marshaller {
 }
 
 func getDiscoveryServiceTypeUrl(apiVersion, ds string) (string, error) {
-	// TODO support api version 3.
-	if apiVersion != _apiVersion2 {
-		panic("unknown api version")
+	typeURLs, ok := _typeURLMap[apiVersion]
+	if !ok {
+		return "", fmt.Errorf("bad api version: %s", apiVersion)
 	}
-	typeURL, ok := _typeURLMap[ds]
+	typeURL, ok := typeURLs[ds]
 	if !ok {
 		return "", fmt.Errorf("unknown discovery service: %s", ds)
 	}
 	return typeURL, nil
 }
 
+// buildResourceNames groups the --resource-names values by the resource type.
+// A value like "eds=a" starts the names of a type, the values after it without
+// the type prefix belong to the same type, so "eds=a,b" subscribes both a and
+// b. Values without any type prefix are only allowed when a single type is
+// subscribed.
+func buildResourceNames(apiVersion string, typeURLs []string, values []string) (map[string][]string, error) {
+	resourceNames := make(map[string][]string, len(typeURLs))
+	current := ""
+	if len(typeURLs) == 1 {
+		current = typeURLs[0]
+	}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if typeURL, ok := _typeURLMap[apiVersion][parts[0]]; ok && len(parts) == 2 {
+			if !containsString(typeURLs, typeURL) {
+				return nil, fmt.Errorf("%v: %s is not subscribed", _errInvalidResourceNames, parts[0])
+			}
+			current, value = typeURL, parts[1]
+		}
+		if current == "" {
+			return nil, fmt.Errorf("%v: the type of %s is ambiguous", _errInvalidResourceNames, value)
+		}
+		if value != "" {
+			resourceNames[current] = append(resourceNames[current], value)
+		}
+	}
+	return resourceNames, nil
+}
+
 func validateXDS() error {
 	// FIXME Maybe just let user ensure the validity of node id?
 	if _gFlags.xds.node != "" {
@@ -137,6 +337,8 @@ func validateXDS() error {
 		if parts[0] != "sidecar" && parts[0] != "router" {
 			return _errInvalidNode
 		}
+	} else if id := _gFlags.xds.bootstrapNode.GetId(); id != "" {
+		_gFlags.xds.node = id
 	} else {
 		_gFlags.xds.node = genNodeID()
 	}
@@ -144,7 +346,12 @@ func validateXDS() error {
 	return nil
 }
 
+// buildNodeMetadata parses the --node-metadata value, the metadata is nil if
+// it's empty, so that the metadata of the bootstrap node is kept.
 func buildNodeMetadata(meta string) (*_struct.Struct, error) {
+	if meta == "" {
+		return nil, nil
+	}
 	metadata := &_struct.Struct{
 		Fields: make(map[string]*_struct.Value),
 	}
@@ -162,6 +369,54 @@ func buildNodeMetadata(meta string) (*_struct.Struct, error) {
 	return metadata, nil
 }
 
+func buildInitialResourceVersions(pairs []string) (map[string]string, error) {
+	versions := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, _errInvalidInitialResourceVersions
+		}
+		versions[parts[0]] = parts[1]
+	}
+	return versions, nil
+}
+
+// buildHeaders makes the outgoing metadata from the --header values and the
+// initial metadata of the bootstrap, which are only taken for the keys that
+// neither --header nor the token sets.
+func buildHeaders(pairs, bootstrapPairs []string, token bool) (metadata.MD, error) {
+	md, err := parseHeaders(pairs)
+	if err != nil {
+		return nil, err
+	}
+	bootstrapMD, err := parseHeaders(bootstrapPairs)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range bootstrapMD {
+		if _, ok := md[key]; ok || token && key == _authorizationHeader {
+			continue
+		}
+		md[key] = values
+	}
+	return md, nil
+}
+
+// parseHeaders parses the key=value pairs to the metadata, the keys are case
+// insensitive and the reserved ones are refused.
+func parseHeaders(pairs []string) (metadata.MD, error) {
+	md := metadata.MD{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || key == "" || strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") {
+			return nil, fmt.Errorf("%v: %s", _errInvalidHeader, pair)
+		}
+		md.Append(key, parts[1])
+	}
+	return md, nil
+}
+
 func genNodeID() string {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -193,7 +448,18 @@ func genNodeID() string {
 	return fmt.Sprintf("sidecar~%s~%d~%s", addr, rand.Int(), hostname)
 }
 
-func validateOptions() error {
+func validateOptions(cmd *cobra.Command) error {
+	if _gFlags.envoyBootstrap != "" {
+		if _gFlags.bootstrap != "" {
+			return _errBootstrapConflict
+		}
+		if err := applyEnvoyBootstrap(cmd); err != nil {
+			return err
+		}
+	} else if err := applyGRPCBootstrap(cmd); err != nil {
+		return err
+	}
+
 	if err := validateAPIVersion(_gFlags.xds.apiVersion); err != nil {
 		return err
 	}
@@ -206,12 +472,60 @@ func validateOptions() error {
 		return _errInvalidGRPCMaxCallRecvSize
 	}
 
+	if _gFlags.initialWindowSize < 0 || _gFlags.initialConnWindowSize < 0 {
+		return _errInvalidWindowSize
+	}
+
 	if err := validateOutputFormat(); err != nil {
 		return err
 	}
 
+	if err := validateTransport(); err != nil {
+		return err
+	}
+
 	if err := validateXDS(); err != nil {
 		return err
 	}
+
+	if _gFlags.fanOut && (_gFlags.watch || _gFlags.delta) {
+		return _errFanOutConflict
+	}
+
+	if _gFlags.interactive && !_gFlags.watch {
+		return _errInteractiveNeedsWatch
+	}
+
+	if !_gFlags.delta && len(_gFlags.xds.initialResourceVersions) > 0 {
+		return _errInvalidInitialResourceVersions
+	}
 	return nil
 }
+
+// verbosef prints the message to stderr if --verbose is specified.
+func verbosef(ctx *context, format string, args ...interface{}) {
+	if ctx.flags.verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
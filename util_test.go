@@ -0,0 +1,229 @@
+// Copyright 2020 xdscli Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	gcontext "context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestBuildResourceNames(t *testing.T) {
+	typeURLs := _typeURLMap[_apiVersion3]
+	cds, eds := typeURLs["cds"], typeURLs["eds"]
+
+	tests := []struct {
+		types  []string
+		values []string
+		want   map[string][]string
+		err    bool
+	}{
+		{
+			types:  []string{cds},
+			values: nil,
+			want:   map[string][]string{},
+		},
+		{
+			types:  []string{eds},
+			values: []string{"a", "b"},
+			want:   map[string][]string{eds: {"a", "b"}},
+		},
+		{
+			types:  []string{eds},
+			values: []string{"eds=a", "b"},
+			want:   map[string][]string{eds: {"a", "b"}},
+		},
+		{
+			types:  []string{cds, eds},
+			values: []string{"cds=c1", "eds=e1", "e2", "cds=c2"},
+			want:   map[string][]string{cds: {"c1", "c2"}, eds: {"e1", "e2"}},
+		},
+		{
+			// A value with "=" that is not a type prefix is a name.
+			types:  []string{eds},
+			values: []string{"x=y"},
+			want:   map[string][]string{eds: {"x=y"}},
+		},
+		{
+			types:  []string{cds, eds},
+			values: []string{"eds="},
+			want:   map[string][]string{},
+		},
+		{
+			types:  []string{cds, eds},
+			values: []string{"a"},
+			err:    true,
+		},
+		{
+			types:  []string{cds},
+			values: []string{"eds=a"},
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := buildResourceNames(_apiVersion3, tt.types, tt.values)
+		if tt.err {
+			if err == nil || !strings.HasPrefix(err.Error(), _errInvalidResourceNames.Error()) {
+				t.Errorf("%v: expected %v, got %v", tt.values, _errInvalidResourceNames, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, expected %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAndResolveServers(t *testing.T) {
+	tests := []struct {
+		servers []string
+		want    []endpoint
+		err     bool
+	}{
+		{
+			servers: []string{"unix:///var/run/xds.sock"},
+			want:    []endpoint{{addr: "unix:/var/run/xds.sock", authority: "localhost"}},
+		},
+		{
+			servers: []string{"unix:xds.sock"},
+			want:    []endpoint{{addr: "unix:xds.sock", authority: "localhost"}},
+		},
+		{
+			servers: []string{"127.0.0.1:15010", "[::1]:15010"},
+			want: []endpoint{
+				{addr: "127.0.0.1:15010", authority: "127.0.0.1:15010"},
+				{addr: "[::1]:15010", authority: "[::1]:15010"},
+			},
+		},
+		{
+			// The host is kept as the authority without resolver.
+			servers: []string{"xds.test:15010"},
+			want:    []endpoint{{addr: "xds.test:15010", authority: "xds.test:15010"}},
+		},
+		{
+			servers: []string{"dns:///127.0.0.1:15010", "dns:xds.test:15012"},
+			want: []endpoint{
+				{addr: "127.0.0.1:15010", authority: "127.0.0.1:15010"},
+				{addr: "xds.test:15012", authority: "xds.test:15012"},
+			},
+		},
+		{
+			servers: []string{"dns://127.0.0.1:53/127.0.0.1:15010"},
+			want:    []endpoint{{addr: "127.0.0.1:15010", authority: "127.0.0.1:15010"}},
+		},
+		{servers: []string{"unix:"}, err: true},
+		{servers: []string{"unix://"}, err: true},
+		{servers: []string{"dns://127.0.0.1:53"}, err: true},
+		{servers: []string{"127.0.0.1:15010:1"}, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := validateAndResolveServers(gcontext.Background(), tt.servers, nil)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected error", tt.servers)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.servers, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, expected %v", tt.servers, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAndResolveServersLookup(t *testing.T) {
+	endpoints, err := validateAndResolveServers(gcontext.Background(), []string{"localhost:15010"}, net.DefaultResolver)
+	if err != nil {
+		t.Skipf("localhost is not resolvable: %v", err)
+	}
+	if len(endpoints) == 0 {
+		t.Fatal("localhost is resolved to nothing")
+	}
+	for _, ep := range endpoints {
+		host, _, err := net.SplitHostPort(ep.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			t.Errorf("localhost is resolved to %s", ep.addr)
+		}
+		// The certificate is verified against the original host.
+		if ep.authority != "localhost:15010" {
+			t.Errorf("the authority of %s is %s", ep.addr, ep.authority)
+		}
+	}
+}
+
+func TestBuildHeaders(t *testing.T) {
+	tests := []struct {
+		pairs          []string
+		bootstrapPairs []string
+		token          bool
+		want           metadata.MD
+		err            bool
+	}{
+		{
+			pairs: []string{"X-Tenant=a", "x-tenant=b", "authorization=Bearer t1"},
+			want:  metadata.MD{"x-tenant": {"a", "b"}, "authorization": {"Bearer t1"}},
+		},
+		{
+			pairs:          []string{"authorization=Bearer from-flag"},
+			bootstrapPairs: []string{"authorization=Bearer from-bootstrap", "x-cluster=c1"},
+			want:           metadata.MD{"authorization": {"Bearer from-flag"}, "x-cluster": {"c1"}},
+		},
+		{
+			bootstrapPairs: []string{"authorization=Bearer from-bootstrap", "x-cluster=c1"},
+			token:          true,
+			want:           metadata.MD{"x-cluster": {"c1"}},
+		},
+		{
+			bootstrapPairs: []string{"authorization=Bearer from-bootstrap"},
+			want:           metadata.MD{"authorization": {"Bearer from-bootstrap"}},
+		},
+		{pairs: []string{"x-tenant"}, err: true},
+		{pairs: []string{":authority=a"}, err: true},
+		{pairs: []string{"grpc-timeout=1s"}, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := buildHeaders(tt.pairs, tt.bootstrapPairs, tt.token)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected error", tt.pairs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.pairs, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v %v: got %v, expected %v", tt.pairs, tt.bootstrapPairs, got, tt.want)
+		}
+	}
+}